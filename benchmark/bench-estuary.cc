@@ -21,7 +21,9 @@
 #include <algorithm>
 #include <thread>
 #include <string>
+#include <vector>
 #include <chrono>
+#include <memory>
 #include <sys/sysinfo.h>
 #include <estuary.h>
 #include <gflags/gflags.h>
@@ -32,6 +34,13 @@ DEFINE_uint32(thread, 4, "number of worker threads");
 DEFINE_bool(build, false, "build instead of fetching");
 DEFINE_bool(copy, false, "load by copy");
 DEFINE_bool(disable_write, false, "disable write");
+DEFINE_bool(wyhash, false, "build with wyhash instead of spooky hash");
+DEFINE_string(dist, "uniform", "key distribution: uniform or zipf");
+DEFINE_double(zipf_theta, 0.99, "skew of zipf distribution, in (0, 1)");
+DEFINE_uint32(loop, 1000000, "operations per worker thread");
+DEFINE_uint32(warmup, 100000, "untimed operations per worker thread before measuring");
+DEFINE_uint32(write_percent, 0, "percentage of updates in worker operations, for mixed workload");
+DEFINE_bool(latency, false, "time each operation and report percentiles");
 
 static constexpr size_t SIZE = 1UL << 27U;
 
@@ -47,10 +56,22 @@ static int BenchFetch() {
 		return 1;
 	}
 
+	std::unique_ptr<ZipfGenerator> zipf;
+	if (FLAGS_dist == "zipf") {
+		if (FLAGS_zipf_theta <= 0.0 || FLAGS_zipf_theta >= 1.0) {
+			std::cout << "zipf_theta should be in (0, 1)" << std::endl;
+			return 1;
+		}
+		zipf.reset(new ZipfGenerator(SIZE, FLAGS_zipf_theta));
+	} else if (FLAGS_dist != "uniform") {
+		std::cout << "unknown distribution: " << FLAGS_dist << std::endl;
+		return 1;
+	}
+
 	uint64_t write_ops = 0;
 	uint64_t write_ns = 0;
 	bool quit = FLAGS_disable_write;
-	std::thread writer([ &dict, &quit, &write_ops, &write_ns](){
+	std::thread writer([&dict, &zipf, &quit, &write_ops, &write_ns](){
 		XorShift128Plus rnd;
 		uint64_t key = 0;
 		uint8_t val[UINT8_MAX];
@@ -62,7 +83,7 @@ static int BenchFetch() {
 
 		auto start = std::chrono::steady_clock::now();
 		for (; !quit; write_ops++) {
-			key = rnd() % SIZE;
+			key = zipf? (*zipf)(rnd) : rnd() % SIZE;
 			dict.update({(const uint8_t*)&key, sizeof(uint64_t)}, {val, len++});
 		}
 		auto end = std::chrono::steady_clock::now();
@@ -71,24 +92,48 @@ static int BenchFetch() {
 
 
 	const unsigned n = FLAGS_thread;
-	constexpr unsigned loop = 1000000;
+	const unsigned loop = FLAGS_loop;
 
 	std::vector<std::thread> workers;
 	workers.reserve(n);
 	std::vector<uint64_t> results(n);
+	std::vector<std::vector<uint32_t>> latencies(n);
 	for (unsigned i = 0; i < n; i++) {
-		workers.emplace_back([&dict, loop](uint64_t* res){
+		workers.emplace_back([&dict, &zipf, loop](uint64_t* res, std::vector<uint32_t>* lat){
 			XorShift128Plus rnd;
 			uint64_t key = 0;
 			std::string val;
+			uint8_t buf[UINT8_MAX];
+			uint8_t len = 0;
+			memset(buf, 0, sizeof(buf));
+			auto op = [&]() {
+				key = zipf? (*zipf)(rnd) : rnd() % SIZE;
+				if (FLAGS_write_percent != 0 && rnd() % 100 < FLAGS_write_percent) {
+					dict.update({(const uint8_t*)&key, sizeof(uint64_t)}, {buf, len++});
+				} else {
+					dict.fetch({(const uint8_t*)&key, sizeof(uint64_t)}, val);
+				}
+			};
+			for (unsigned i = 0; i < FLAGS_warmup; i++) {
+				op();
+			}
+			if (FLAGS_latency) {
+				lat->resize(loop);
+			}
 			auto start = std::chrono::steady_clock::now();
 			for (unsigned i = 0; i < loop; i++) {
-				key = rnd() % SIZE;
-				dict.fetch({(const uint8_t*)&key, sizeof(uint64_t)}, val);
+				if (FLAGS_latency) {
+					auto a = std::chrono::steady_clock::now();
+					op();
+					auto b = std::chrono::steady_clock::now();
+					(*lat)[i] = std::chrono::duration_cast<std::chrono::nanoseconds>(b - a).count();
+				} else {
+					op();
+				}
 			}
 			auto end = std::chrono::steady_clock::now();
 			*res = std::chrono::duration_cast<std::chrono::nanoseconds>(end - start).count();
-		}, &results[i]);
+		}, &results[i], &latencies[i]);
 	}
 	for (auto& t : workers) {
 		t.join();
@@ -105,8 +150,24 @@ static int BenchFetch() {
 	}
 	ns /= n*(uint64_t)loop;
 
-	std::cout << "read: " << (qps/1000000.0) << " mqps with " << n << " threads" << std::endl;
-	std::cout << "read: " << ns << " ns/op" << std::endl;
+	const char* kind = FLAGS_write_percent == 0? "read: " : "mixed: ";
+	std::cout << kind << (qps/1000000.0) << " mqps with " << n << " threads" << std::endl;
+	std::cout << kind << ns << " ns/op" << std::endl;
+	if (FLAGS_latency) {
+		std::vector<uint32_t> all;
+		all.reserve(n*(size_t)loop);
+		for (auto& lat : latencies) {
+			all.insert(all.end(), lat.begin(), lat.end());
+		}
+		std::sort(all.begin(), all.end());
+		if (!all.empty()) {
+			auto pct = [&all](double p)->uint32_t {
+				return all[std::min<size_t>(all.size()*p, all.size()-1)];
+			};
+			std::cout << kind << "p50=" << pct(0.5) << " p99=" << pct(0.99)
+				<< " p999=" << pct(0.999) << " max=" << all.back() << " ns" << std::endl;
+		}
+	}
 	if (!FLAGS_disable_write) {
 		std::cout << "write: " << (write_ops * 1000.0 / write_ns) << " mqps" << std::endl;
 	}
@@ -119,6 +180,9 @@ static int BenchBuild() {
 	config.max_key_len = sizeof(uint64_t);
 	config.max_val_len = UINT8_MAX;
 	config.avg_size_per_item = UINT8_MAX/2 + 1 + sizeof(uint64_t);
+	if (FLAGS_wyhash) {
+		config.hash_func = estuary::Estuary::Config::WYHASH;
+	}
 
 	VariedValueGenerator source(0, SIZE);
 	if (!estuary::Estuary::Create(FLAGS_file, config, &source)) {
@@ -136,6 +200,9 @@ int main(int argc, char* argv[]) {
 	if (FLAGS_thread == 0 || FLAGS_thread > cpus) {
 		FLAGS_thread = cpus;
 	}
+	if (FLAGS_loop == 0) {
+		FLAGS_loop = 1;
+	}
 
 	if (FLAGS_build) {
 		return BenchBuild();
@@ -18,6 +18,7 @@
 
 #pragma once
 
+#include <cmath>
 #include <random>
 #include "../test/test.h"
 
@@ -39,4 +40,36 @@ public:
 	}
 private:
 	uint64_t _s[2];
-};
\ No newline at end of file
+};
+
+//YCSB style zipfian ranks in [0, n), theta in (0, 1), rank 0 is the hottest
+class ZipfGenerator final {
+public:
+	ZipfGenerator(uint64_t n, double theta) : m_n(n) {
+		for (uint64_t i = 1; i <= n; i++) {
+			m_zetan += 1.0 / std::pow((double)i, theta);
+		}
+		const double zeta2 = 1.0 + std::pow(0.5, theta);
+		m_alpha = 1.0 / (1.0 - theta);
+		m_eta = (1.0 - std::pow(2.0/n, 1.0-theta)) / (1.0 - zeta2/m_zetan);
+		m_half = 1.0 + std::pow(0.5, theta);
+	}
+	uint64_t operator()(XorShift128Plus& rnd) const noexcept {
+		const double u = (rnd() >> 11U) * (1.0 / (1ULL << 53U));
+		const double uz = u * m_zetan;
+		if (uz < 1.0) {
+			return 0;
+		}
+		if (uz < m_half) {
+			return 1;
+		}
+		auto rank = (uint64_t)(m_n * std::pow(m_eta*u - m_eta + 1.0, m_alpha));
+		return rank < m_n? rank : m_n-1;
+	}
+private:
+	uint64_t m_n;
+	double m_zetan = 0.0;
+	double m_alpha = 0.0;
+	double m_eta = 0.0;
+	double m_half = 0.0;
+};
@@ -0,0 +1,170 @@
+//==============================================================================
+// Dictionary designed for read-mostly scene.
+// Copyright (C) 2020  Ruan Kunliang
+//
+// This library is free software; you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation; either version 2.1 of the License, or (at your option)
+// any later version.
+//
+// This library is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+//==============================================================================
+
+#include <cstring>
+#include <iostream>
+#include <atomic>
+#include <thread>
+#include <string>
+#include <vector>
+#include <chrono>
+#include <memory>
+#include <estuary.h>
+#include <gflags/gflags.h>
+#include "benchmark.h"
+
+DEFINE_string(file, "stress.es", "dict filename");
+DEFINE_uint32(reader, 4, "number of reader threads");
+DEFINE_uint32(second, 10, "duration in seconds");
+DEFINE_uint32(key, 100000, "number of stable keys");
+
+//one writer updates stable keys and churns extra keys to trigger sweeping,
+//readers validate every value of stable keys and check versions never go back
+
+static constexpr unsigned MAX_VAL_LEN = 200;
+
+static unsigned ValueLength(uint32_t key, uint32_t version) {
+	return sizeof(uint64_t) + (key * 7U + version * 13U) % (MAX_VAL_LEN - sizeof(uint64_t) + 1);
+}
+
+static void FillValue(uint32_t key, uint32_t version, std::string& out) {
+	out.resize(ValueLength(key, version));
+	auto p = (uint32_t*)out.data();
+	p[0] = key;
+	p[1] = version;
+	for (unsigned i = sizeof(uint64_t); i < out.size(); i++) {
+		out[i] = (char)(key * 31U + version + i);
+	}
+}
+
+static bool CheckValue(uint32_t key, const std::string& val, uint32_t& version) {
+	if (val.size() < sizeof(uint64_t)) {
+		return false;
+	}
+	auto p = (const uint32_t*)val.data();
+	if (p[0] != key || val.size() != ValueLength(key, p[1])) {
+		return false;
+	}
+	for (unsigned i = sizeof(uint64_t); i < val.size(); i++) {
+		if (val[i] != (char)(key * 31U + p[1] + i)) {
+			return false;
+		}
+	}
+	version = p[1];
+	return true;
+}
+
+int main(int argc, char* argv[]) {
+	google::ParseCommandLineFlags(&argc, &argv, true);
+	if (FLAGS_reader == 0 || FLAGS_key == 0) {
+		std::cout << "bad arguments" << std::endl;
+		return 1;
+	}
+	const uint64_t churn_base = FLAGS_key;
+	const uint64_t churn_size = FLAGS_key / 4 + 1;
+
+	estuary::Estuary::Config config;
+	config.item_limit = FLAGS_key + churn_size;
+	config.max_key_len = sizeof(uint64_t);
+	config.max_val_len = MAX_VAL_LEN;
+	config.avg_size_per_item = MAX_VAL_LEN/2 + sizeof(uint64_t);
+	config.concurrency = FLAGS_reader;
+	if (!estuary::Estuary::Create(FLAGS_file, config)) {
+		std::cout << "fail to create: " << FLAGS_file << std::endl;
+		return 1;
+	}
+	auto dict = estuary::Estuary::Load(FLAGS_file);
+	if (!dict) {
+		std::cout << "fail to load: " << FLAGS_file << std::endl;
+		return 1;
+	}
+
+	std::string val;
+	for (uint64_t key = 0; key < FLAGS_key; key++) {
+		FillValue(key, 0, val);
+		if (!dict.update({(const uint8_t*)&key, sizeof(key)}, {(const uint8_t*)val.data(), val.size()})) {
+			std::cout << "fail to init" << std::endl;
+			return 1;
+		}
+	}
+
+	std::atomic<bool> quit(false);
+	std::atomic<uint64_t> broken(0);
+	std::atomic<uint64_t> missing(0);
+	uint64_t write_ops = 0;
+
+	std::thread writer([&dict, &quit, &broken, &write_ops, churn_base, churn_size](){
+		XorShift128Plus rnd;
+		std::vector<uint32_t> versions(FLAGS_key, 0);
+		std::string val;
+		for (; !quit.load(std::memory_order_relaxed); write_ops++) {
+			uint64_t key = rnd() % FLAGS_key;
+			FillValue(key, ++versions[key], val);
+			if (!dict.update({(const uint8_t*)&key, sizeof(key)}, {(const uint8_t*)val.data(), val.size()})) {
+				broken++;
+			}
+			key = churn_base + rnd() % churn_size;
+			if (rnd() % 2 == 0) {
+				dict.erase({(const uint8_t*)&key, sizeof(key)});
+			} else {
+				FillValue(key, 0, val);
+				dict.update({(const uint8_t*)&key, sizeof(key)}, {(const uint8_t*)val.data(), val.size()});
+			}
+		}
+	});
+
+	std::vector<uint64_t> read_ops(FLAGS_reader, 0);
+	std::vector<std::thread> readers;
+	readers.reserve(FLAGS_reader);
+	for (unsigned i = 0; i < FLAGS_reader; i++) {
+		readers.emplace_back([&dict, &quit, &broken, &missing](uint64_t* ops){
+			XorShift128Plus rnd;
+			auto seen = std::make_unique<uint32_t[]>(FLAGS_key);
+			memset(seen.get(), 0, FLAGS_key*sizeof(uint32_t));
+			std::string val;
+			for (; !quit.load(std::memory_order_relaxed); (*ops)++) {
+				uint64_t key = rnd() % FLAGS_key;
+				if (!dict.fetch({(const uint8_t*)&key, sizeof(key)}, val)) {
+					missing++;
+					continue;
+				}
+				uint32_t version = 0;
+				if (!CheckValue(key, val, version) || version < seen[key]) {
+					broken++;
+					continue;
+				}
+				seen[key] = version;
+			}
+		}, &read_ops[i]);
+	}
+
+	std::this_thread::sleep_for(std::chrono::seconds(FLAGS_second));
+	quit = true;
+	for (auto& t : readers) {
+		t.join();
+	}
+	writer.join();
+
+	uint64_t total_read = 0;
+	for (auto n : read_ops) {
+		total_read += n;
+	}
+	std::cout << "read: " << total_read << ", write: " << write_ops << std::endl;
+	std::cout << "broken: " << broken << ", missing: " << missing << std::endl;
+	return broken == 0 && missing == 0? 0 : 1;
+}
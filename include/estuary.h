@@ -23,6 +23,9 @@
 #include <cstdarg>
 #include <cstdint>
 #include <cstring>
+#include <atomic>
+#include <chrono>
+#include <functional>
 #include <new>
 #include <string>
 #include <vector>
@@ -32,12 +35,267 @@
 
 namespace estuary {
 
+class StatsRecorder;
+class LatencyRecorder;
+
 class Estuary final {
 public:
+	//out works as a reusable buffer, memory is allocated only when its capacity is not enough
 	bool fetch(Slice key, std::string& out) const;
+
+	using Timestamp = std::chrono::system_clock::time_point;
+	struct RecordMeta {
+		Timestamp mtime;	//zero without Config::record_stamp
+	};
+	bool fetch_with_meta(Slice key, std::string& out, RecordMeta& meta) const;
+	enum FetchStatus {NOT_FOUND, NOT_MODIFIED, FOUND};
+	//value is fetched only if it's modified after since, always fetch without Config::record_stamp
+	FetchStatus fetch_if_modified_since(Slice key, Timestamp since, std::string& out) const;
+
+	//value referring to mapped data without copying, any write may change it,
+	//so bytes read from it are trustworthy only if view_valid returns true afterwards
+	struct View {
+		Slice val;
+		uint64_t generation = 0;
+	};
+	bool fetch_view(Slice key, View& view) const;
+	bool view_valid(const View& view) const noexcept;
 	bool erase(Slice key) const;
 	bool update(Slice key, Slice val) const;
 
+	//why an operation fails
+	enum class Error : uint8_t {
+		OK = 0,
+		BAD_ARGUMENT,	//null pointer, empty key or unloaded instance
+		KEY_TOO_LONG,
+		VAL_TOO_LONG,
+		INVALID,		//refused by validator
+		FROZEN,			//sealed or frozen
+		NO_SPACE,		//data blocks run out
+		TABLE_FULL,		//item limit is reached or no entry available
+		TIMEOUT,
+		NOT_FOUND,
+	};
+	static const char* ErrorName(Error err) noexcept;
+	//variants of fetch, update and erase telling why they fail
+	Error try_fetch(Slice key, std::string& out) const;
+	Error try_update(Slice key, Slice val) const;
+	Error try_erase(Slice key) const;
+
+	//copy at most limit bytes of value from offset, out is empty if offset is beyond the end
+	bool fetch_range(Slice key, size_t offset, size_t limit, std::string& out) const;
+
+	//fetch many keys with memory prefetching, vals and found are resized to keys.size(),
+	//return number of found ones
+	size_t batch_fetch(const std::vector<Slice>& keys, std::vector<std::string>& vals,
+					   std::vector<bool>& found) const;
+
+	//variants with code from hash(key) to avoid hashing twice, key transform is not applied
+	uint64_t hash(Slice key) const noexcept;
+	bool fetch_hashed(uint64_t code, Slice key, std::string& out) const;
+	bool erase_hashed(uint64_t code, Slice key) const;
+	bool update_hashed(uint64_t code, Slice key, Slice val) const;
+
+	using Deadline = std::chrono::system_clock::time_point;
+	//give up if waiting for writer lock or maintenance work exceeds the deadline
+	bool update(Slice key, Slice val, Deadline deadline) const;
+	Error try_update(Slice key, Slice val, Deadline deadline) const;
+
+	struct IngestOptions {
+		unsigned batch = 1000;			//items written in one holding of writer lock
+		bool stop_on_failure = true;	//or skip items which can't be written, like when out of capacity
+		std::function<void(size_t done, size_t total)> progress;	//called after every batch
+	};
+	//write all items from source, return number of written ones
+	size_t ingest(IDataReader& source, const IngestOptions& options) const;
+
+	//apply all operations in one holding of writer lock, done is resized to the input size,
+	//return number of successful ones
+	size_t update_batch(const std::vector<IDataReader::Record>& items, std::vector<bool>& done) const;
+	size_t erase_batch(const std::vector<Slice>& keys, std::vector<bool>& done) const;
+
+	//set helpers, members are kept in value with compact encoding (member length <= 65535)
+	//key will be erased when its last member is removed
+	bool add_to_set(Slice key, Slice member) const;
+	bool remove_from_set(Slice key, Slice member) const;
+	bool members(Slice key, std::vector<std::string>& out) const;
+
+	//combine operand into val (empty when exists is false), return false to cancel
+	using MergeOperator = std::function<bool(Slice operand, std::string& val, bool exists)>;
+
+	//rewrite val (empty when exists is false) under writer lock, return false to cancel
+	using Updater = std::function<bool(std::string& val, bool exists)>;
+	bool update_with(Slice key, const Updater& func) const;
+
+	//overwrite bytes of existing value from offset in place, value length is unchanged,
+	//fail if the range is out of value
+	bool patch_value(Slice key, size_t offset, Slice patch) const;
+
+	//append suffix to value (empty when missing), fail if it becomes longer than max_val_len
+	bool append(Slice key, Slice suffix) const;
+
+	//treat value as 8-byte little-endian counter (0 when missing) and add delta to it,
+	//fail if existing value has other length
+	bool add(Slice key, int64_t delta, int64_t& result) const;
+
+	//item expires after ttl and is treated as missing, its blocks are reclaimed when erased,
+	//overwritten or met by relocation, fail without Config::record_ttl
+	//plain update resets ttl to Config::default_ttl, while read-modify-write helpers like update_with keep it
+	bool update_ttl(Slice key, Slice val, std::chrono::microseconds ttl) const;
+	//reset ttl of a live item in place without rewriting its value, 0 means never expiring
+	bool touch(Slice key, std::chrono::microseconds ttl) const;
+
+	//check at most limit entries from where last call stopped and erase expired items,
+	//return number of erased ones
+	size_t expire_sweep(size_t limit) const;
+
+	//update and take out the replaced value in one holding of writer lock
+	bool get_set(Slice key, Slice val, std::string& old, bool& existed) const;
+
+	using Visitor = std::function<void(Slice key, Slice val)>;
+	//visit all items in order of Hash(key, seed), which is independent of table layout
+	//writing is blocked during the procedure
+	void for_each_stable(const Visitor& visitor, uint64_t seed=0) const;
+
+	struct Item {
+		std::string key;
+		std::string val;
+	};
+	//fetch at most limit items from cursor, return next cursor (0 means the end)
+	//writing is blocked within each call but not between calls, fetching is never blocked,
+	//items moved by sweeping between two calls may be missed or visited twice
+	uint64_t scan(uint64_t cursor, size_t limit, std::vector<Item>& out) const;
+
+	//collect at most limit keys matching glob pattern, writer lock is released periodically,
+	//so keys moved by sweeping in the meantime may be missed or collected twice
+	void keys(Slice pattern, size_t limit, std::vector<std::string>& out) const;
+
+	//count keys matching the predicate, writer lock is released periodically
+	//so the result is approximate when writing concurrently
+	size_t count(const std::function<bool(Slice key)>& pred) const;
+
+	//write items whose key starts with prefix to a file for import_from, cnt takes number of them
+	//writer lock is released periodically so it's not a snapshot when writing concurrently
+	//stamp and ttl are not kept
+	bool export_prefix(Slice prefix, const std::string& path, size_t* cnt=nullptr) const;
+	//write all items of an exported file like ingest, return number of written ones
+	//keys are taken as they are, key transform is not applied again
+	size_t import_from(const std::string& path, const IngestOptions& options) const;
+
+	struct Stats {
+		uint64_t fetch_hit = 0;
+		uint64_t fetch_miss = 0;
+		uint64_t update = 0;
+		uint64_t erase = 0;
+		uint64_t reject = 0;	//failed writing
+		uint64_t fetch_retry = 0;		//extra probes for entries moved or changed under readers
+		uint64_t fetch_retry_hit = 0;	//found only on retry during sweeping, included in fetch_hit
+		uint64_t evict = 0;
+		uint64_t tombstone = 0;			//current deleted entries, always available
+		uint64_t logical_byte = 0;		//key and value bytes of records written
+		uint64_t data_byte = 0;			//bytes written to data area, including relocation copies
+		double hit_ratio() const noexcept {
+			auto total = fetch_hit + fetch_miss;
+			return total == 0? 0.0 : fetch_hit / (double)total;
+		}
+		double write_amplification() const noexcept {
+			return logical_byte == 0? 0.0 : data_byte / (double)logical_byte;
+		}
+	};
+	//fetch may miss entries being moved during sweeping, so it retries if a write has run meanwhile
+	struct RetryPolicy {
+		unsigned times = 2;			//0 means no retry
+		unsigned backoff_us = 0;	//wait backoff_us<<(n-1) microseconds before the n-th retry
+	};
+	void set_fetch_retry(const RetryPolicy& policy) noexcept { m_retry = policy; }
+
+	//operation counting costs some read performance, so it's disabled by default
+	void enable_stats();
+	//count within recent seconds (at most 60), or all time after enabled when window is 0
+	Stats stats(unsigned window=0) const;
+
+	//turn entries pointing to broken records into deleted ones, so that a damaged instance
+	//keeps usable until rebuilding, blocks of them are leaked, return number of new ones
+	size_t quarantine() const;
+	size_t quarantined() const noexcept;	//total number
+
+	//reject all writes (including from other processes) until thawed, the state is kept in file
+	//and goes with dump, so the instance is quiescent without holding the lock from outside
+	bool freeze_writes() const;
+	bool thaw_writes() const;
+	bool writes_frozen() const noexcept;
+	//reject writes and make pages of table and data read-only, then fetch goes without locking,
+	//only for instances loaded in MONOPOLY or COPY_DATA mode, the state is not kept in file,
+	//non-zero load_factor (0-1) means fetch uses a copy of the table rebuilt in memory at it
+	bool seal(double load_factor=0);
+	//restore writing, it must not be called along with any reading since fetch has no lock when sealed
+	bool unseal();
+
+	struct Latency {
+		static constexpr unsigned BUCKET_COUNT = 40;
+		uint64_t bucket[BUCKET_COUNT] = {};	//operations taking [2^i, 2^(i+1)) nanoseconds, the last one takes all longer
+		uint64_t count() const noexcept;
+		uint64_t percentile(double ratio) const noexcept;	//upper bound in nanoseconds, 0 when empty
+	};
+	//timing costs even more than counting, so it's separated
+	void enable_latency_stats();
+	Latency fetch_latency() const;
+	Latency write_latency() const;
+
+	//keys are normalized by the transform before any operation, the same one should be
+	//set in Config for Create and by set_key_transform after Load, output may be empty
+	using KeyTransform = std::function<void(Slice key, std::string& out)>;
+	void set_key_transform(KeyTransform transform) { m_key_transform = std::move(transform); }
+
+	//values rejected by the validator will not be written, including those from source in Create
+	using Validator = std::function<bool(Slice key, Slice val)>;
+	void set_validator(Validator validator) { m_validator = std::move(validator); }
+
+	struct AuditEvent {
+		enum Op {UPDATE, ERASE} op = UPDATE;
+		uint64_t key_hash = 0;		//stable across instances and rebuilding
+		size_t size = 0;			//value length
+		bool done = false;
+		uint64_t latency_ns = 0;
+		Timestamp time;
+	};
+	//sink is called for every write after the master lock is released, it should not throw
+	using AuditSink = std::function<void(const AuditEvent&)>;
+	void set_audit_sink(AuditSink sink) { m_audit = std::move(sink); }
+
+	//deleted entries lengthen probing until swept, which happens when clean entries run out
+	size_t tombstone() const noexcept;
+	//sweep earlier when new deleted entries since last sweep exceed ratio of the table, 0 means never
+	void set_tombstone_limit(double ratio) noexcept;
+
+	//hooks may be called under writer lock, they should be quick and not write to the instance
+	struct Hooks {
+		std::function<void(Slice key)> on_evict;					//before an item is evicted
+		std::function<void(Slice key, Error reason)> on_reject;		//when an update fails
+		std::function<void(size_t tombstone)> on_sweep;				//after sweeping, with deleted entries left
+	};
+	void set_hooks(Hooks hooks) { m_hooks = std::move(hooks); }
+
+	//erase items to make room instead of rejecting writes when full, each victim is the oldest
+	//(by Config::record_stamp, or just random without it) among so many random samples,
+	//expired items go first, 0 means never
+	void set_eviction(unsigned samples) noexcept;
+
+	//called when self_test or quarantine finds broken entries,
+	//writes are frozen before that if freeze is set, so that the damage will not spread
+	using CorruptionHandler = std::function<void(const Estuary&)>;
+	void on_corruption(CorruptionHandler handler, bool freeze=true);
+
+	//check some random entries: record intact and reachable from its bucket, report the first problem,
+	//all entries are checked when sample is not less than the table size, writing is blocked meanwhile
+	bool self_test(unsigned sample) const;
+
+	std::string metadata() const;	//given in Config at creating
+	//increases on every modification and goes with dump, so any change since a seen value is detectable,
+	//it's odd while a write is in progress, and failed writes may increase it too,
+	//but updating a key with the same value (without ttl) changes nothing
+	uint64_t generation() const noexcept;
+
 	bool operator!() const noexcept { return m_meta == nullptr; }
 	unsigned max_key_len() const noexcept { return m_const.max_key_len; }
 	unsigned max_val_len() const noexcept { return m_const.max_val_len; }
@@ -48,12 +306,23 @@ public:
 	Estuary() = default;
 	Estuary(Estuary&& other) noexcept
 		: m_resource(std::move(other.m_resource)), m_const(other.m_const),
-		  m_meta(other.m_meta), m_locks(other.m_locks), m_table(other.m_table), m_data(other.m_data),
-		  m_monopoly_extra(std::move(other.m_monopoly_extra)) {
+		  m_meta(other.m_meta), m_ext(other.m_ext), m_locks(other.m_locks), m_table(other.m_table),
+		  m_data(other.m_data), m_monopoly_extra(std::move(other.m_monopoly_extra)),
+		  m_legacy_ext(std::move(other.m_legacy_ext)),
+		  m_retry(other.m_retry), m_tombstone_limit(other.m_tombstone_limit),
+		  m_hooks(std::move(other.m_hooks)), m_reject(other.m_reject),
+		  m_evict_samples(other.m_evict_samples), m_evict_rnd(other.m_evict_rnd),
+		  m_sealed(other.m_sealed.load()), m_sparse(std::move(other.m_sparse)), m_corruption(std::move(other.m_corruption)), m_audit(std::move(other.m_audit)),
+		  m_key_transform(std::move(other.m_key_transform)), m_validator(std::move(other.m_validator)),
+		  m_stats(other.m_stats), m_latency(other.m_latency), m_scratch(std::move(other.m_scratch)),
+		  m_key_scratch(std::move(other.m_key_scratch)) {
 		other.m_meta = nullptr;
+		other.m_ext = nullptr;
 		other.m_locks = nullptr;
 		other.m_table = nullptr;
 		other.m_data = nullptr;
+		other.m_stats = nullptr;
+		other.m_latency = nullptr;
 	}
 	Estuary& operator=(Estuary&& other) noexcept {
 		if (&other != this) {
@@ -67,36 +336,91 @@ public:
 	static constexpr unsigned MAX_KEY_LEN = UINT8_MAX;
 	static constexpr unsigned MAX_VAL_LEN = (1U<<24U)-1U;
 	struct Config {
-		size_t item_limit = 1000;			//128-8589934656
+		size_t item_limit = 1000;			//171-11453246123, see GetLimits
 		unsigned max_key_len = 32;			//1-255
-		unsigned max_val_len = 1048576;		//1-16777215
-		unsigned avg_size_per_item = 2048;	//2-16777215
+		unsigned max_val_len = 1048576;		//0-16777215, 0 for key-only set
+		unsigned avg_size_per_item = 2048;	//1-16777215
+		unsigned block_size = 8;			//8, 16, 32 or 64, larger one means fewer blocks for large values
+		unsigned data_reserve_factor = 10;	//2-255, 1/factor of data area is kept clean for relocation
+		unsigned entry_reserve_factor = 8;	//4-255, sweep when clean entries drop to 1/factor of table
 		unsigned concurrency = 64;			//1-512
+		bool record_stamp = false;			//keep last-modified time, 8 bytes per item
+		bool record_ttl = false;			//keep expiration time, 8 bytes per item
+		std::chrono::microseconds default_ttl{0};	//for items without explicit ttl, implies record_ttl
+		enum {SPOOKY, WYHASH} hash_func = SPOOKY;	//WYHASH is faster for short keys, fixed after creation
+		KeyTransform key_transform;			//normalize keys from source
+		Validator validator;				//check items from source
+		enum {KEEP_LAST, KEEP_FIRST, REJECT, MERGE} on_duplicate = KEEP_LAST;	//for same key in source
+		MergeOperator duplicate_merger;		//merge later value as operand into former one
+		std::string metadata;				//provenance like creator or dataset version, kept in file
+	};
+
+	//limits of the file format in use, for validating configs in tools
+	struct Limits {
+		uint16_t format;
+		size_t min_item_limit;
+		size_t max_item_limit;
+		unsigned max_key_len;
+		unsigned max_val_len;
+		unsigned max_concurrency;
+		unsigned block_size;		//default one
+		unsigned max_block_size;
+		size_t max_data_size;		//bytes, with default block size
+		size_t max_metadata_size;
 	};
+	static Limits GetLimits() noexcept;
 
-	static bool Create(const std::string& path, const Config& config, IDataReader* source=nullptr);
+	struct BuildReport {
+		size_t item = 0;
+		size_t duplicate = 0;		//items with existed key in source
+		size_t data_used = 0;		//bytes taken by records
+		size_t padding = 0;			//bytes wasted by block alignment, included in data_used
+		size_t data_free = 0;		//the same as data_free() after loading
+		size_t max_probe = 0;		//max distance from home bucket to entry
+		double avg_probe = 0.0;
+	};
+	static bool Create(const std::string& path, const Config& config, IDataReader* source=nullptr,
+					   BuildReport* report=nullptr);
 	static bool ResetLocks(const std::string& path);
+	//read metadata without loading
+	static bool ReadMetadata(const std::string& path, std::string& out);
 
 	enum LoadPolicy {SHARED, MONOPOLY, COPY_DATA};
 	//concurrency > 0 means overwriting the origin value in monopoly mode
-	static Estuary Load(const std::string& path, LoadPolicy policy=MONOPOLY, unsigned concurrency=0);
+	//self_test > 0 means refusing the file if any of so many sampled entries is broken
+	//progress is reported only in COPY_DATA mode, mapped files are populated in one go
+	static Estuary Load(const std::string& path, LoadPolicy policy=MONOPOLY, unsigned concurrency=0,
+						unsigned self_test=0, const Progress& progress=nullptr);
 
-	bool dump(const std::string& path) const noexcept {
-		return m_resource.dump(path.c_str());
+	//verify means reading written file back from disk and comparing, which fails
+	//if the instance is modified during dumping
+	bool dump(const std::string& path, const Progress& progress=nullptr, bool verify=false) const noexcept {
+		return m_resource.dump(path.c_str(), progress, verify);
 	}
+	//write a copy to another path with a fresh hash seed, so that the table layout known by
+	//anyone crafting colliding keys becomes useless, records are kept with their stamp and ttl
+	//writing is blocked during the procedure
+	bool rebuild(const std::string& path) const;
 
 	struct Meta;
+	struct MetaExt;
 	struct Locks;
 
 private:
 	MemMap m_resource;
 	Meta* m_meta = nullptr;
+	MetaExt* m_ext = nullptr;
 	struct {
 		uint16_t lock_mask = 0;
 		uint8_t max_key_len = 0;
+		uint8_t block_bits = 0;
+		uint8_t data_reserve = 0;
+		uint8_t entry_reserve = 0;
 		uint32_t max_val_len = 0;
 		uint32_t seed = 0;
 		uint32_t reserved_block = 0;
+		uint32_t extra = 0;
+		uint32_t flags = 0;
 		size_t total_block = 0;
 		Divisor<uint64_t> total_entry;
 	} m_const;
@@ -104,13 +428,65 @@ private:
 	uint64_t* m_table = nullptr;
 	uint8_t* m_data = nullptr;
 	std::unique_ptr<uint8_t[]> m_monopoly_extra;
+	std::unique_ptr<uint8_t[]> m_legacy_ext;	//holds MetaExt for v1 files
+	RetryPolicy m_retry;
+	size_t m_tombstone_limit = 0;
+	Hooks m_hooks;
+	mutable Error m_reject = Error::INVALID;	//why last _update failed, guarded by master lock
+	mutable bool m_unchanged = false;	//last _update changed nothing, guarded by master lock
+	unsigned m_evict_samples = 0;
+	mutable uint64_t m_evict_rnd = 0;	//guarded by master lock
+	std::atomic<bool> m_sealed = false;
+	struct {
+		std::unique_ptr<uint64_t[]> table;	//rebuilt at lower load factor for sealed fetching
+		Divisor<uint64_t> total_entry;
+	} m_sparse;
+	struct {
+		CorruptionHandler handler;
+		bool freeze = false;
+	} m_corruption;
+	AuditSink m_audit;
+	KeyTransform m_key_transform;
+	Validator m_validator;
+	StatsRecorder* m_stats = nullptr;
+	LatencyRecorder* m_latency = nullptr;
+	mutable std::string m_scratch;	//reusable buffer for writing, guarded by master lock
+	mutable std::string m_key_scratch;	//reusable buffer for key transform in batches, guarded by master lock
 
 	Estuary(const Estuary&) noexcept = delete;
 	Estuary& operator=(const Estuary&) noexcept = delete;
 
-	bool _fetch(Slice key, std::string& out) const;
-	bool _erase(Slice key) const;
-	bool _update(Slice key, Slice val) const;
+	bool _fetch(Slice key, uint64_t code, std::string& out, uint64_t* stamp, uint64_t since,
+				size_t offset=0, size_t limit=SIZE_MAX) const;
+	bool _fetch_once(Slice key, uint64_t code, std::string& out, uint64_t* stamp, uint64_t since,
+					 size_t offset, size_t limit) const;
+	bool _fetch_sealed(Slice key, uint64_t code, std::string& out, uint64_t* stamp, uint64_t since,
+					   size_t offset, size_t limit) const;
+	bool _erase(Slice key, uint64_t code) const;
+	size_t _ingest(IDataReader& source, const IngestOptions& options, bool canonical) const;
+	Error _check(Slice key, const Slice* val) const noexcept;
+	Error _try_erase(uint64_t code, Slice key) const;
+	Error _try_update(uint64_t code, Slice key, Slice val) const;
+	bool _update(Slice key, uint64_t code, Slice val, const Deadline* deadline=nullptr, uint64_t expiry=0) const;
+	bool _update_in_place(Slice key, uint64_t code, Slice val, uint64_t expiry) const;
+	void _begin_write() const;
+	void _end_write() const;
+	bool _moving(uint64_t& generation) const;
+	void _fill_extra(uint8_t* block, uint64_t expiry) const;
+	bool _expired(uint8_t* block) const;
+	void _drop(size_t pos) const;
+	bool _evict() const;
+	uint64_t _inherit_expiry(uint8_t* block) const;
+	uint64_t _default_expiry() const;
+	void _sweep() const;
+	void _relocate(size_t vic) const;
+	bool _intact(uint64_t blk, uint32_t tag) const;
+	void _report_quarantine(size_t idx, uint64_t blk) const;
+	bool _self_test(unsigned sample) const;
+	void _corrupted() const;
+	//func may set *unchanged to succeed without writing
+	template <typename Func>
+	bool _modify(Slice key, const Func& func, const bool* unchanged=nullptr) const;
 };
 
 } //estuary
@@ -0,0 +1,64 @@
+//==============================================================================
+// Dictionary designed for read-mostly scene.
+// Copyright (C) 2020  Ruan Kunliang
+//
+// This library is free software; you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation; either version 2.1 of the License, or (at your option)
+// any later version.
+//
+// This library is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+//==============================================================================
+
+#pragma once
+#ifndef ESTUARY_C_H
+#define ESTUARY_C_H
+
+#include <stddef.h>
+#include <stdint.h>
+#include <sys/types.h>
+
+//C interface for other languages, exceptions are caught inside
+//a handle can be used by many threads like Estuary
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct estuary_handle estuary_t;
+
+enum {
+	ESTUARY_SHARED = 0,
+	ESTUARY_MONOPOLY = 1,
+	ESTUARY_COPY_DATA = 2,
+};
+
+//create an empty file with default config except these, return 0 on success, -2 on error
+extern int estuary_create(const char* path, size_t item_limit, unsigned max_key_len,
+						  unsigned max_val_len, unsigned avg_size_per_item);
+
+//return NULL on failure
+extern estuary_t* estuary_open(const char* path, int policy);
+extern void estuary_close(estuary_t* es);
+
+//return length of value, -1 when missing, -2 on error
+//value is copied into buf only if it fits in buf_len, call again with enough space otherwise
+extern ssize_t estuary_fetch(estuary_t* es, const void* key, size_t key_len, void* buf, size_t buf_len);
+//return 1 on success, 0 on failure, -2 on error
+extern int estuary_update(estuary_t* es, const void* key, size_t key_len, const void* val, size_t val_len);
+extern int estuary_erase(estuary_t* es, const void* key, size_t key_len);
+
+extern size_t estuary_item(const estuary_t* es);
+extern unsigned estuary_max_key_len(const estuary_t* es);
+extern unsigned estuary_max_val_len(const estuary_t* es);
+
+#ifdef __cplusplus
+}
+#endif
+#endif //ESTUARY_C_H
@@ -23,11 +23,15 @@
 #include <cstdint>
 #include <cstdarg>
 #include <new>
+#include <functional>
 #include <utility>
 #include <type_traits>
 
 namespace estuary {
 
+//called with bytes done and total bytes, it should not throw
+using Progress = std::function<void(size_t done, size_t total)>;
+
 class MemMap final {
 public:
 	MemMap() noexcept = default;
@@ -37,7 +41,7 @@ public:
 
 	struct LoadByCopy {};
 	static constexpr LoadByCopy load_by_copy = {};
-	explicit MemMap(const char* path, LoadByCopy);
+	MemMap(const char* path, LoadByCopy, const Progress& progress=nullptr);
 
 	MemMap(MemMap&& other) noexcept
 		: m_addr(other.m_addr), m_size(other.m_size), m_fd(other.m_fd) {
@@ -57,7 +61,10 @@ public:
 	uint8_t* addr() const noexcept { return m_addr; }
 	const uint8_t* end() const noexcept { return m_addr + m_size; }
 	bool operator!() const noexcept { return m_addr == nullptr; }
-	bool dump(const char* path) const noexcept;
+	//verify means reading written file back from disk and comparing
+	bool dump(const char* path, const Progress& progress=nullptr, bool verify=false) const noexcept;
+	//change access of whole pages behind off
+	bool protect(size_t off, bool writable) noexcept;
 private:
 	MemMap(const MemMap&) noexcept = delete;
 	MemMap& operator=(const MemMap&) noexcept = delete;
@@ -71,6 +78,9 @@ struct Slice final {
 	size_t len = 0;
 };
 
+//glob-style matching on bytes, supports '*', '?', '[...]', '[!...]' and '\\' escape
+extern bool GlobMatch(Slice pattern, Slice text) noexcept;
+
 struct IDataReader {
 	struct Record {
 		Slice key;
@@ -96,6 +106,24 @@ private:
 	static Logger* s_instance;
 };
 
+//source of record stamps and hash seeds, tests may bind a fake one to be deterministic
+class Clock {
+public:
+	virtual ~Clock() = default;
+	virtual uint64_t now() = 0;		//microseconds since epoch
+	virtual uint64_t seed() = 0;
+	static uint64_t Now();
+	static uint64_t Seed();
+	//null means the system clock
+	static Clock* Bind(Clock* clock) noexcept {
+		auto old = s_instance;
+		s_instance = clock;
+		return old;
+	}
+private:
+	static Clock* s_instance;
+};
+
 //Granlund-Montgomery
 template <typename Word>
 class Divisor final {
@@ -0,0 +1,152 @@
+#===============================================================================
+# Dictionary designed for read-mostly scene.
+# Copyright (C) 2020  Ruan Kunliang
+#
+# This library is free software; you can redistribute it and/or modify it under
+# the terms of the GNU Lesser General Public License as published by the Free
+# Software Foundation; either version 2.1 of the License, or (at your option)
+# any later version.
+#
+# This library is distributed in the hope that it will be useful, but WITHOUT
+# ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+# FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+# details.
+#
+# You should have received a copy of the GNU Lesser General Public License
+# along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+#===============================================================================
+
+# Thin wrapper of the C interface (include/estuary_c.h) in libestuary.so.
+#
+#   with Estuary("data.es") as es:
+#       val = es.get(b"key")
+
+import ctypes
+import ctypes.util
+import os
+import threading
+
+SHARED, MONOPOLY, COPY_DATA = 0, 1, 2
+
+
+def _load_library(path=None):
+    if path is None:
+        path = os.environ.get("ESTUARY_LIBRARY") or ctypes.util.find_library("estuary") or "libestuary.so"
+    lib = ctypes.CDLL(path)
+    lib.estuary_create.argtypes = [ctypes.c_char_p, ctypes.c_size_t, ctypes.c_uint,
+                                   ctypes.c_uint, ctypes.c_uint]
+    lib.estuary_create.restype = ctypes.c_int
+    lib.estuary_open.argtypes = [ctypes.c_char_p, ctypes.c_int]
+    lib.estuary_open.restype = ctypes.c_void_p
+    lib.estuary_close.argtypes = [ctypes.c_void_p]
+    lib.estuary_close.restype = None
+    lib.estuary_fetch.argtypes = [ctypes.c_void_p, ctypes.c_char_p, ctypes.c_size_t,
+                                  ctypes.c_void_p, ctypes.c_size_t]
+    lib.estuary_fetch.restype = ctypes.c_ssize_t
+    lib.estuary_update.argtypes = [ctypes.c_void_p, ctypes.c_char_p, ctypes.c_size_t,
+                                   ctypes.c_char_p, ctypes.c_size_t]
+    lib.estuary_update.restype = ctypes.c_int
+    lib.estuary_erase.argtypes = [ctypes.c_void_p, ctypes.c_char_p, ctypes.c_size_t]
+    lib.estuary_erase.restype = ctypes.c_int
+    for name in ("estuary_item", "estuary_max_key_len", "estuary_max_val_len"):
+        getattr(lib, name).argtypes = [ctypes.c_void_p]
+    lib.estuary_item.restype = ctypes.c_size_t
+    lib.estuary_max_key_len.restype = ctypes.c_uint
+    lib.estuary_max_val_len.restype = ctypes.c_uint
+    return lib
+
+
+def _bytes(data):
+    return data.encode() if isinstance(data, str) else bytes(data)
+
+
+def create(path, item_limit, max_key_len, max_val_len, avg_size_per_item, library=None):
+    """Create an empty estuary file, other options take defaults of Estuary::Config."""
+    lib = _load_library(library)
+    if lib.estuary_create(os.fsencode(path), item_limit, max_key_len, max_val_len, avg_size_per_item) != 0:
+        raise OSError("fail to create estuary: %s" % path)
+
+
+class Estuary:
+    """Dictionary in an estuary file, keys and values are bytes (str is encoded as UTF-8)."""
+
+    def __init__(self, path, policy=SHARED, library=None):
+        self._lib = _load_library(library)
+        self._handle = self._lib.estuary_open(os.fsencode(path), policy)
+        if not self._handle:
+            raise OSError("fail to open estuary: %s" % path)
+        self._local = threading.local()    # fetch buffer per thread, grows on demand
+
+    def close(self):
+        if self._handle:
+            self._lib.estuary_close(self._handle)
+            self._handle = None
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *args):
+        self.close()
+
+    def __del__(self):
+        if getattr(self, "_handle", None):
+            self.close()
+
+    def _check(self):
+        if not self._handle:
+            raise ValueError("estuary is closed")
+
+    def get(self, key, default=None):
+        self._check()
+        key = _bytes(key)
+        buf = getattr(self._local, "buf", None)
+        if buf is None:
+            buf = self._local.buf = ctypes.create_string_buffer(256)
+        while True:
+            size = self._lib.estuary_fetch(self._handle, key, len(key), buf, len(buf))
+            if size == -1:
+                return default
+            if size < 0:
+                raise RuntimeError("fail to fetch")
+            if size <= len(buf):
+                return ctypes.string_at(buf, size)
+            buf = self._local.buf = ctypes.create_string_buffer(size)    # retry, value may change again
+
+    def __getitem__(self, key):
+        val = self.get(key)
+        if val is None:
+            raise KeyError(key)
+        return val
+
+    def __contains__(self, key):
+        return self.get(key) is not None
+
+    def __len__(self):
+        self._check()
+        return self._lib.estuary_item(self._handle)
+
+    def update(self, key, val):
+        self._check()
+        key, val = _bytes(key), _bytes(val)
+        ret = self._lib.estuary_update(self._handle, key, len(key), val, len(val))
+        if ret < 0:
+            raise RuntimeError("fail to update")
+        return ret == 1
+
+    def erase(self, key):
+        self._check()
+        key = _bytes(key)
+        ret = self._lib.estuary_erase(self._handle, key, len(key))
+        if ret < 0:
+            raise RuntimeError("fail to erase")
+        return ret == 1
+
+    @property
+    def max_key_len(self):
+        self._check()
+        return self._lib.estuary_max_key_len(self._handle)
+
+    @property
+    def max_val_len(self):
+        self._check()
+        return self._lib.estuary_max_val_len(self._handle)
@@ -0,0 +1,84 @@
+#===============================================================================
+# Dictionary designed for read-mostly scene.
+# Copyright (C) 2020  Ruan Kunliang
+#
+# This library is free software; you can redistribute it and/or modify it under
+# the terms of the GNU Lesser General Public License as published by the Free
+# Software Foundation; either version 2.1 of the License, or (at your option)
+# any later version.
+#
+# This library is distributed in the hope that it will be useful, but WITHOUT
+# ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+# FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+# details.
+#
+# You should have received a copy of the GNU Lesser General Public License
+# along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+#===============================================================================
+
+# ESTUARY_LIBRARY=build/libestuary.so python3 -m unittest python/test_estuary.py
+
+import os
+import tempfile
+import threading
+import unittest
+
+import estuary
+
+
+class TestEstuary(unittest.TestCase):
+
+    def setUp(self):
+        self.dir = tempfile.TemporaryDirectory()
+        self.path = os.path.join(self.dir.name, "test.es")
+        estuary.create(self.path, 1000, 16, 4096, 64)
+
+    def tearDown(self):
+        self.dir.cleanup()
+
+    def test_basic(self):
+        with estuary.Estuary(self.path, estuary.MONOPOLY) as es:
+            self.assertEqual(len(es), 0)
+            self.assertEqual(es.max_key_len, 16)
+            self.assertEqual(es.max_val_len, 4096)
+            self.assertTrue(es.update("a", b"1"))
+            self.assertTrue(es.update(b"b", b"x" * 4000))    # larger than initial buffer
+            self.assertFalse(es.update("c", b"x" * 4097))
+            self.assertEqual(es["a"], b"1")
+            self.assertEqual(es.get("b"), b"x" * 4000)
+            self.assertIsNone(es.get("c"))
+            self.assertNotIn("c", es)
+            with self.assertRaises(KeyError):
+                es["c"]
+            self.assertTrue(es.erase("a"))
+            self.assertFalse(es.erase("a"))
+            self.assertEqual(len(es), 1)
+        with self.assertRaises(ValueError):
+            es.get("b")
+
+    def test_threads(self):
+        with estuary.Estuary(self.path, estuary.MONOPOLY) as es:
+            for i in range(100):
+                es.update(str(i), str(i) * (i + 1))
+            errors = []
+
+            def check(offset):
+                for i in range(100):
+                    j = (i + offset) % 100
+                    if es.get(str(j)) != (str(j) * (j + 1)).encode():
+                        errors.append(j)
+
+            workers = [threading.Thread(target=check, args=(k * 10,)) for k in range(8)]
+            for t in workers:
+                t.start()
+            for t in workers:
+                t.join()
+            self.assertEqual(errors, [])
+
+    def test_bad_file(self):
+        with self.assertRaises(OSError):
+            estuary.Estuary(os.path.join(self.dir.name, "none.es"))
+
+
+if __name__ == "__main__":
+    unittest.main()
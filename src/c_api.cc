@@ -0,0 +1,115 @@
+//==============================================================================
+// Dictionary designed for read-mostly scene.
+// Copyright (C) 2020  Ruan Kunliang
+//
+// This library is free software; you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation; either version 2.1 of the License, or (at your option)
+// any later version.
+//
+// This library is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+//==============================================================================
+
+#include <cstring>
+#include <estuary.h>
+#include <estuary_c.h>
+
+using estuary::Estuary;
+
+struct estuary_handle {
+	Estuary dict;
+};
+
+int estuary_create(const char* path, size_t item_limit, unsigned max_key_len,
+				   unsigned max_val_len, unsigned avg_size_per_item) {
+	if (path == nullptr) {
+		return -2;
+	}
+	Estuary::Config config;
+	config.item_limit = item_limit;
+	config.max_key_len = max_key_len;
+	config.max_val_len = max_val_len;
+	config.avg_size_per_item = avg_size_per_item;
+	try {
+		return Estuary::Create(path, config)? 0 : -2;
+	} catch (...) {
+		return -2;
+	}
+}
+
+estuary_t* estuary_open(const char* path, int policy) {
+	if (path == nullptr || policy < ESTUARY_SHARED || policy > ESTUARY_COPY_DATA) {
+		return nullptr;
+	}
+	try {
+		auto dict = Estuary::Load(path, static_cast<Estuary::LoadPolicy>(policy));
+		if (!dict) {
+			return nullptr;
+		}
+		return new estuary_handle{std::move(dict)};
+	} catch (...) {
+		return nullptr;
+	}
+}
+
+void estuary_close(estuary_t* es) {
+	delete es;
+}
+
+ssize_t estuary_fetch(estuary_t* es, const void* key, size_t key_len, void* buf, size_t buf_len) {
+	if (es == nullptr) {
+		return -2;
+	}
+	thread_local std::string out;
+	try {
+		if (!es->dict.fetch({(const uint8_t*)key, key_len}, out)) {
+			return -1;
+		}
+	} catch (...) {
+		return -2;
+	}
+	if (buf != nullptr && out.size() <= buf_len) {
+		memcpy(buf, out.data(), out.size());
+	}
+	return out.size();
+}
+
+int estuary_update(estuary_t* es, const void* key, size_t key_len, const void* val, size_t val_len) {
+	if (es == nullptr) {
+		return -2;
+	}
+	try {
+		return es->dict.update({(const uint8_t*)key, key_len}, {(const uint8_t*)val, val_len});
+	} catch (...) {
+		return -2;
+	}
+}
+
+int estuary_erase(estuary_t* es, const void* key, size_t key_len) {
+	if (es == nullptr) {
+		return -2;
+	}
+	try {
+		return es->dict.erase({(const uint8_t*)key, key_len});
+	} catch (...) {
+		return -2;
+	}
+}
+
+size_t estuary_item(const estuary_t* es) {
+	return es == nullptr? 0 : es->dict.item();
+}
+
+unsigned estuary_max_key_len(const estuary_t* es) {
+	return es == nullptr? 0 : es->dict.max_key_len();
+}
+
+unsigned estuary_max_val_len(const estuary_t* es) {
+	return es == nullptr? 0 : es->dict.max_val_len();
+}
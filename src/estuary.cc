@@ -17,14 +17,31 @@
 //==============================================================================
 
 #include <cassert>
+#include <cerrno>
+#include <cctype>
+#include <algorithm>
+#include <ctime>
+#include <thread>
 #include <pthread.h>
+#include <fcntl.h>
+#include <unistd.h>
 #include <estuary.h>
 #include "internal.h"
 #include "spin_rwlock.h"
+#include "layout.h"
+#include "stats.h"
 
 namespace estuary {
 
-static constexpr uint16_t MAGIC = 0xE999;
+static constexpr uint16_t MAGIC = 0xE99A;
+static constexpr uint16_t MAGIC_V1 = 0xE999;	//without extended header, loaded as flags=0
+
+enum : uint32_t {
+	FLAG_RECORD_STAMP = 1U,		//last-modified time is kept behind value
+	FLAG_RECORD_TTL = 2U,		//expiration time is kept behind value and last-modified time
+	FLAG_WYHASH = 4U,			//keys are hashed by WyHash instead of SpookyHash
+};
+
 struct Estuary::Meta {
 	uint16_t magic = MAGIC;
 	uint16_t lock_mask = 0;
@@ -40,7 +57,28 @@ struct Estuary::Meta {
 	size_t free_block = 0;
 	size_t block_cursor = 0;
 };
-using Header = Estuary::Meta;
+
+//extended header, v1 files don't have it and keep one in memory instead
+struct Estuary::MetaExt {
+	uint32_t flags = 0;
+	bool frozen = false;		//writes are rejected
+	uint8_t block_shift = 0;	//block size is DATA_BLOCK_SIZE << block_shift
+	uint8_t data_reserve = 0;	//0 means DATA_RESERVE_FACTOR
+	uint8_t entry_reserve = 0;	//0 means ENTRY_RESERVE_FACTOR
+	uint64_t quarantined = 0;
+	uint64_t swept_dirty = 0;	//deleted entries left by last sweep
+	uint64_t metadata_size = 0;	//metadata is kept behind data area
+	uint64_t generation = 0;	//count of modifications
+	uint64_t default_ttl = 0;	//microseconds, 0 means never expire
+	uint64_t expire_cursor = 0;	//where expire_sweep goes on
+};
+
+struct Header : public Estuary::Meta, public Estuary::MetaExt {};
+static_assert(sizeof(Estuary::Meta) == 64 && sizeof(Header) == sizeof(Estuary::Meta) + sizeof(Estuary::MetaExt));
+
+static FORCE_INLINE size_t HeaderSize(uint16_t magic) {
+	return magic == MAGIC_V1? sizeof(Estuary::Meta) : sizeof(Header);
+}
 
 size_t Estuary::item() const noexcept {
 	return m_meta == nullptr? 0 : m_meta->item;
@@ -85,22 +123,20 @@ struct Estuary::Locks {
 	SharedMutex pool[0];
 };
 
-static constexpr size_t DATA_BLOCK_SIZE = 8;
-static_assert((DATA_BLOCK_SIZE % sizeof(uint64_t)) == 0);
-
 static constexpr size_t MIN_ENTRY = 256;
 static constexpr size_t MAX_ENTRY = 1ULL << 34U;
 
-static constexpr unsigned ADDR_BITWIDTH = 43;
-static constexpr size_t DATA_BLOCK_LIMIT = (1ULL << ADDR_BITWIDTH) - 2U;
-
+//defaults, they can be set in Config
 static constexpr size_t DATA_RESERVE_FACTOR = 10;   // 1/DATA_RESERVE_FACTOR data is reserved clean
 static constexpr size_t ENTRY_RESERVE_FACTOR = 8;   // 1/ENTRY_RESERVE_FACTOR entries are reserved clean
+static constexpr size_t MIN_DATA_RESERVE_FACTOR = 2;
+static constexpr size_t MIN_ENTRY_RESERVE_FACTOR = 4;
+static constexpr size_t MAX_RESERVE_FACTOR = UINT8_MAX;
 static constexpr size_t TotalEntry(size_t item_limit) { return item_limit*3/2; }
 static constexpr size_t ItemLimit(size_t entry) { return entry*2/3; }
-static_assert(ENTRY_RESERVE_FACTOR > 3);
+static_assert(MIN_ENTRY_RESERVE_FACTOR > 3);
 static_assert(MAX_ENTRY < DATA_BLOCK_LIMIT / 2);
-static_assert(MIN_ENTRY > ENTRY_RESERVE_FACTOR);
+static_assert(MIN_ENTRY > MAX_RESERVE_FACTOR);
 
 const char* LockException::what() const noexcept {
 	return "fail to handle lock";
@@ -109,94 +145,69 @@ const char* DataException::what() const noexcept {
 	return "broken data";
 }
 
-union RecordMark {
-	struct {
-		uint32_t klen : 8;
-		uint32_t vlen : 24;
-		uint8_t part[4];
-	};
-	struct {
-		uint64_t klen_ : 8;
-		uint64_t bcnt : 56;
-	};
-};
-
-static FORCE_INLINE RecordMark& Rc(uint8_t* block) {
-	return *(RecordMark*)block;
+static FORCE_INLINE uint64_t CurrentStamp() {
+	return Clock::Now();
 }
-static FORCE_INLINE uint8_t* RcKey(uint8_t* block) {
-	return block + sizeof(uint32_t);
-}
-static FORCE_INLINE uint8_t* RcVal(uint8_t* block) {
-	return block + sizeof(uint32_t) + Rc(block).klen;
+
+#define GET_LOCK(tag) (m_locks->pool+((tag)&m_const.lock_mask))
+
+#define BLK(idx) (m_data+((idx)<<m_const.block_bits))
+
+#define HAS_STAMP ((m_const.flags & FLAG_RECORD_STAMP) != 0)
+#define HAS_TTL ((m_const.flags & FLAG_RECORD_TTL) != 0)
+#define HASH(ptr, len) ((m_const.flags & FLAG_WYHASH)? WyHash(ptr, len, m_const.seed) : Hash(ptr, len, m_const.seed))
+#define EXPIRY(block) (*(uint64_t*)(RcExtra(block) + (HAS_STAMP? sizeof(uint64_t) : 0)))
+
+//expiry of 0 means never, KEEP_EXPIRY means inheriting from the live record being replaced
+static constexpr uint64_t KEEP_EXPIRY = UINT64_MAX;
+
+//generation works as a seqlock, it's odd while tables or data blocks may be changing,
+//so any write (even a failed one which only relocates records) invalidates views,
+//except an update with unchanged value, which restores the generation at end
+void Estuary::_begin_write() const {
+	m_meta->writing = true;
+	m_unchanged = false;
+	StoreRelaxed(m_ext->generation, m_ext->generation+1);
+	ReleaseFence();
 }
 
-static FORCE_INLINE bool KeyMatch(Slice key, uint8_t* block) {
-	if (Rc(block).klen != key.len) {
-		return false;
-	} else if (key.len == sizeof(uint64_t)) {
-		return *(const uint64_t*)key.ptr == *(const uint64_t*)RcKey(block);
+void Estuary::_end_write() const {
+	if (m_unchanged) {
+		StoreRelease(m_ext->generation, m_ext->generation-1);
 	} else {
-		return memcmp(key.ptr, RcKey(block), key.len) == 0;
+		StoreRelease(m_ext->generation, m_ext->generation+1);
 	}
-}
-static FORCE_INLINE bool ValMatch(Slice val, uint8_t* block) {
-	return Rc(block).vlen == val.len
-		   && memcmp(val.ptr, RcVal(block), val.len) == 0;
-}
-
-static FORCE_INLINE size_t RecordBlocks(size_t klen, size_t vlen) {
-	assert(klen != 0);
-	return ((sizeof(uint32_t)+klen+vlen)+(DATA_BLOCK_SIZE-1)) / DATA_BLOCK_SIZE;
-}
-static FORCE_INLINE size_t RecordBlocks(uint8_t* block) {
-	return RecordBlocks(Rc(block).klen, Rc(block).vlen);
+	m_meta->writing = false;
 }
 
-static_assert(ADDR_BITWIDTH < 63U);
-static constexpr unsigned TAG_BITWIDTH = 63U - ADDR_BITWIDTH;
-
-struct Entry {
-	uint64_t blk : ADDR_BITWIDTH;
-	uint64_t fit : 1;
-	uint64_t tag : TAG_BITWIDTH;
-	Entry() = default;
-	explicit constexpr Entry(uint64_t b, uint64_t t=(1UL<<TAG_BITWIDTH)-1U) : blk(b), fit(0), tag(t) {}
-	FORCE_INLINE void store_release(Entry e) const noexcept {
-		union {
-			Entry e;
-			uint64_t u;
-		} t = { .e = e };
-		StoreRelease(*(uint64_t*)this, t.u);
+void Estuary::_fill_extra(uint8_t* block, uint64_t expiry) const {
+	if (HAS_STAMP) {
+		*(uint64_t*)RcExtra(block) = CurrentStamp();
 	}
-	FORCE_INLINE void load_relaxed(const Entry& e) noexcept {
-		union {
-			Entry e;
-			uint64_t u;
-		} t = { .u = LoadRelaxed(*(const uint64_t*)&e) };
-		*this = t.e;
+	if (HAS_TTL) {
+		EXPIRY(block) = expiry;
 	}
-};
-static_assert(sizeof(Entry)==sizeof(uint64_t));
-
-static constexpr uint64_t MAX_ADDR = (1ULL << ADDR_BITWIDTH) - 1U;
-static constexpr uint64_t RESERVED_ADDR = (1ULL << ADDR_BITWIDTH) - 2U;
-static constexpr Entry CLEAN_ENTRY = Entry(MAX_ADDR);
-static constexpr Entry DELETED_ENTRY = Entry(RESERVED_ADDR);
-
-static_assert(DATA_BLOCK_LIMIT <= RESERVED_ADDR);
-
-static FORCE_INLINE bool IsEmpty(Entry ent) noexcept {
-	return ent.blk >= RESERVED_ADDR;
 }
-static FORCE_INLINE bool IsClean(Entry ent) noexcept {
-	return ent.blk > RESERVED_ADDR;
+
+bool Estuary::_expired(uint8_t* block) const {
+	if (LIKELY(!HAS_TTL)) {
+		return false;
+	}
+	const auto expiry = EXPIRY(block);
+	return expiry != 0 && expiry <= Clock::Now();
 }
 
-static_assert(TAG_BITWIDTH >= 16U && TAG_BITWIDTH <= 32U);
-#define GET_LOCK(tag) (m_locks->pool+((tag)&m_const.lock_mask))
+//an expired record is treated as missing, so the new one starts with default ttl
+uint64_t Estuary::_inherit_expiry(uint8_t* block) const {
+	if (!HAS_TTL) {
+		return 0;
+	}
+	return _expired(block)? _default_expiry() : EXPIRY(block);
+}
 
-#define BLK(idx) (m_data+(idx)*DATA_BLOCK_SIZE)
+uint64_t Estuary::_default_expiry() const {
+	return m_ext->default_ttl != 0? Clock::Now() + m_ext->default_ttl : 0;
+}
 
 template <typename Func>
 static FORCE_INLINE void SearchInTable(const Func& func, uint64_t code, Entry* table, const Divisor<uint64_t>& total_entry) {
@@ -214,34 +225,448 @@ static FORCE_INLINE void SearchInTable(const Func& func, uint64_t code, Entry* t
 	}
 }
 
+void Estuary::enable_stats() {
+	if (m_meta != nullptr && m_stats == nullptr) {
+		m_stats = new StatsRecorder;
+	}
+}
+
+Estuary::Stats Estuary::stats(unsigned window) const {
+	Stats out;
+	out.tombstone = tombstone();
+	if (m_stats == nullptr) {
+		return out;
+	}
+	uint64_t cnt[StatsRecorder::KIND_COUNT];
+	m_stats->sum(window, cnt);
+	out.fetch_hit = cnt[StatsRecorder::FETCH_HIT];
+	out.fetch_miss = cnt[StatsRecorder::FETCH_MISS];
+	out.update = cnt[StatsRecorder::UPDATE];
+	out.erase = cnt[StatsRecorder::ERASE];
+	out.reject = cnt[StatsRecorder::REJECT];
+	out.fetch_retry = cnt[StatsRecorder::FETCH_RETRY];
+	out.fetch_retry_hit = cnt[StatsRecorder::FETCH_RETRY_HIT];
+	out.evict = cnt[StatsRecorder::EVICT];
+	out.logical_byte = cnt[StatsRecorder::LOGICAL_BYTE];
+	out.data_byte = cnt[StatsRecorder::DATA_BYTE];
+	return out;
+}
+
+void Estuary::enable_latency_stats() {
+	if (m_meta != nullptr && m_latency == nullptr) {
+		m_latency = new LatencyRecorder;
+	}
+}
+
+static_assert(Estuary::Latency::BUCKET_COUNT == LatencyRecorder::BUCKET_COUNT);
+
+Estuary::Latency Estuary::fetch_latency() const {
+	Latency out;
+	if (m_latency != nullptr) {
+		m_latency->copy(LatencyRecorder::FETCH, out.bucket);
+	}
+	return out;
+}
+
+Estuary::Latency Estuary::write_latency() const {
+	Latency out;
+	if (m_latency != nullptr) {
+		m_latency->copy(LatencyRecorder::WRITE, out.bucket);
+	}
+	return out;
+}
+
+uint64_t Estuary::Latency::count() const noexcept {
+	uint64_t sum = 0;
+	for (auto cnt : bucket) {
+		sum += cnt;
+	}
+	return sum;
+}
+
+uint64_t Estuary::Latency::percentile(double ratio) const noexcept {
+	const auto total = count();
+	if (total == 0) {
+		return 0;
+	}
+	const auto limit = (uint64_t)(total * std::max(0.0, std::min(ratio, 1.0)));
+	uint64_t sum = 0;
+	for (unsigned i = 0; i < BUCKET_COUNT; i++) {
+		sum += bucket[i];
+		if (sum >= limit && sum != 0) {
+			return (2ULL << i) - 1;
+		}
+	}
+	return UINT64_MAX;
+}
+
+#define RECORD_STATS(done, yes, no) do { \
+		if (UNLIKELY(m_stats != nullptr)) { \
+			m_stats->add((done)? StatsRecorder::yes : StatsRecorder::no); \
+		} \
+	} while (false)
+
+#define REPORT_REJECT(key, reason) do { \
+		if (UNLIKELY(m_hooks.on_reject != nullptr)) { \
+			m_hooks.on_reject((key), (reason)); \
+		} \
+	} while (false)
+
+#define RECORD_COUNT(kind, n) do { \
+		if (UNLIKELY(m_stats != nullptr)) { \
+			m_stats->add(StatsRecorder::kind, (n)); \
+		} \
+	} while (false)
+
+#define TIME_IT(kind) LatencyRecorder::Timer _timer(m_latency, LatencyRecorder::kind)
+
+//report a write to audit sink when leaving the scope
+class Auditor final {
+public:
+	Auditor(const Estuary::AuditSink& sink, Estuary::AuditEvent::Op op, Slice key, size_t size) : m_sink(sink) {
+		if (UNLIKELY(m_sink != nullptr)) {
+			m_event.op = op;
+			m_event.key_hash = Hash(key.ptr, key.len, 0);
+			m_event.size = size;
+			m_start = std::chrono::steady_clock::now();
+		}
+	}
+	~Auditor() noexcept {
+		if (UNLIKELY(m_sink != nullptr) && !m_canceled) {
+			m_event.latency_ns = std::chrono::duration_cast<std::chrono::nanoseconds>(
+					std::chrono::steady_clock::now() - m_start).count();
+			m_event.time = std::chrono::system_clock::now();
+			m_sink(m_event);
+		}
+	}
+	void set(Estuary::AuditEvent::Op op, bool done, size_t size) noexcept {
+		m_event.op = op;
+		m_event.done = done;
+		m_event.size = size;
+	}
+	void cancel() noexcept { m_canceled = true; }
+
+private:
+	const Estuary::AuditSink& m_sink;
+	Estuary::AuditEvent m_event;
+	std::chrono::steady_clock::time_point m_start;
+	bool m_canceled = false;
+	Auditor(const Auditor&) noexcept = delete;
+	Auditor& operator=(const Auditor&) noexcept = delete;
+};
+
+#define AUDIT(op, key, size) Auditor _auditor(m_audit, AuditEvent::op, key, size)
+
+//apply key transform if set, the result lives in current scope
+#define CANONICAL_KEY(key) \
+	std::string _key_buf; \
+	if (UNLIKELY(m_key_transform != nullptr) && key.ptr != nullptr) { \
+		m_key_transform(key, _key_buf); \
+		key = {(const uint8_t*)_key_buf.data(), _key_buf.size()}; \
+	}
+
+uint64_t Estuary::hash(Slice key) const noexcept {
+	return HASH(key.ptr, key.len);
+}
+
+const char* Estuary::ErrorName(Error err) noexcept {
+	switch (err) {
+		case Error::OK: return "ok";
+		case Error::BAD_ARGUMENT: return "bad argument";
+		case Error::KEY_TOO_LONG: return "key too long";
+		case Error::VAL_TOO_LONG: return "value too long";
+		case Error::INVALID: return "invalid";
+		case Error::FROZEN: return "frozen";
+		case Error::NO_SPACE: return "no space";
+		case Error::TABLE_FULL: return "table full";
+		case Error::TIMEOUT: return "timeout";
+		case Error::NOT_FOUND: return "not found";
+	}
+	return "unknown";
+}
+
+//check arguments like public methods do, val is optional
+Estuary::Error Estuary::_check(Slice key, const Slice* val) const noexcept {
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0
+		|| (val != nullptr && val->len != 0 && val->ptr == nullptr)) {
+		return Error::BAD_ARGUMENT;
+	}
+	if (key.len > max_key_len()) {
+		return Error::KEY_TOO_LONG;
+	}
+	if (val != nullptr && val->len > max_val_len()) {
+		return Error::VAL_TOO_LONG;
+	}
+	return Error::OK;
+}
+
 bool Estuary::fetch(Slice key, std::string& out) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+		return false;
+	}
+	return fetch_hashed(HASH(key.ptr, key.len), key, out);
+}
+
+size_t Estuary::batch_fetch(const std::vector<Slice>& keys, std::vector<std::string>& vals,
+							std::vector<bool>& found) const {
+	vals.resize(keys.size());
+	found.assign(keys.size(), false);
+	if (m_meta == nullptr) {
+		return 0;
+	}
+	//reused by calls in the same thread
+	thread_local struct {
+		std::vector<std::string> key_bufs;
+		std::vector<Slice> keys;
+		std::vector<uint64_t> codes;
+	} scratch;
+	auto& codes = scratch.codes;
+	codes.resize(keys.size());
+	if (m_key_transform != nullptr) {
+		if (scratch.key_bufs.size() < keys.size()) {
+			scratch.key_bufs.resize(keys.size());
+		}
+		scratch.keys.resize(keys.size());
+		for (size_t i = 0; i < keys.size(); i++) {
+			auto& key = scratch.keys[i];
+			key = keys[i];
+			if (key.ptr != nullptr) {
+				m_key_transform(key, scratch.key_bufs[i]);
+				key = {(const uint8_t*)scratch.key_bufs[i].data(), scratch.key_bufs[i].size()};
+			}
+		}
+	}
+	const auto& canonical = m_key_transform != nullptr? scratch.keys : keys;
+	auto table = (const Entry*)m_table;
+	for (size_t i = 0; i < keys.size(); i++) {
+		auto& key = canonical[i];
+		if (key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+			continue;
+		}
+		codes[i] = HASH(key.ptr, key.len);
+		PrefetchForNext(table + codes[i] % m_const.total_entry);
+	}
+	for (size_t i = 0; i < keys.size(); i++) {
+		if (canonical[i].ptr == nullptr || canonical[i].len == 0 || canonical[i].len > max_key_len()) {
+			continue;
+		}
+		const auto e = table[codes[i] % m_const.total_entry];
+		if (!IsEmpty(e)) {
+			PrefetchForNext(BLK(e.blk));
+		}
+	}
+	size_t cnt = 0;
+	for (size_t i = 0; i < keys.size(); i++) {
+		const auto& key = canonical[i];
+		if (key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+			vals[i].clear();
+			continue;
+		}
+		TIME_IT(FETCH);
+		const bool done = _fetch(key, codes[i], vals[i], nullptr, 0);
+		RECORD_STATS(done, FETCH_HIT, FETCH_MISS);
+		found[i] = done;
+		cnt += done;
+	}
+	return cnt;
+}
+
+bool Estuary::fetch_hashed(uint64_t code, Slice key, std::string& out) const {
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+		return false;
+	}
+#ifdef ENABLE_CONSISTENCY_CHECK
+	ConsistencyAssert(code == HASH(key.ptr, key.len));
+#endif
+	TIME_IT(FETCH);
+	auto done = _fetch(key, code, out, nullptr, 0);
+	RECORD_STATS(done, FETCH_HIT, FETCH_MISS);
+	return done;
+}
+
+bool Estuary::fetch_range(Slice key, size_t offset, size_t limit, std::string& out) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+		out.clear();
+		return false;
+	}
+	TIME_IT(FETCH);
+	auto done = _fetch(key, HASH(key.ptr, key.len), out, nullptr, 0, offset, limit);
+	RECORD_STATS(done, FETCH_HIT, FETCH_MISS);
+	return done;
+}
+
+Estuary::Error Estuary::try_fetch(Slice key, std::string& out) const {
+	CANONICAL_KEY(key);
+	auto err = _check(key, nullptr);
+	if (err != Error::OK) {
+		return err;
+	}
+	return fetch_hashed(HASH(key.ptr, key.len), key, out)? Error::OK : Error::NOT_FOUND;
+}
+
+bool Estuary::fetch_with_meta(Slice key, std::string& out, RecordMeta& meta) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+		return false;
+	}
+	TIME_IT(FETCH);
+	uint64_t stamp = 0;
+	auto done = _fetch(key, HASH(key.ptr, key.len), out, &stamp, 0);
+	RECORD_STATS(done, FETCH_HIT, FETCH_MISS);
+	if (!done) {
+		return false;
+	}
+	meta.mtime = Timestamp(std::chrono::microseconds(stamp));
+	return true;
+}
+
+Estuary::FetchStatus Estuary::fetch_if_modified_since(Slice key, Timestamp since, std::string& out) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+		return NOT_FOUND;
+	}
+	TIME_IT(FETCH);
+	const auto limit = std::chrono::duration_cast<std::chrono::microseconds>(since.time_since_epoch()).count();
+	if (!HAS_STAMP || limit <= 0) {
+		auto done = _fetch(key, HASH(key.ptr, key.len), out, nullptr, 0);
+		RECORD_STATS(done, FETCH_HIT, FETCH_MISS);
+		return done? FOUND : NOT_FOUND;
+	}
+	uint64_t stamp = 0;
+	auto done = _fetch(key, HASH(key.ptr, key.len), out, &stamp, limit);
+	RECORD_STATS(done, FETCH_HIT, FETCH_MISS);
+	if (!done) {
+		return NOT_FOUND;
+	}
+	return stamp > (uint64_t)limit? FOUND : NOT_MODIFIED;
+}
+
+bool Estuary::fetch_view(Slice key, View& view) const {
+	CANONICAL_KEY(key);
+	view = {};
 	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
 		return false;
 	}
-	auto done = _fetch(key, out);
+	TIME_IT(FETCH);
+	const auto code = HASH(key.ptr, key.len);
+	bool done = false;
+	auto search = [this, key, code, &view, &done]() {
+		view.generation = LoadAcquire(m_ext->generation);
+		SearchInTable([this, key, &view, &done](Entry& ent, uint32_t tag)->bool{
+			auto e = ent;
+			if (IsEmpty(e)) {
+				return IsClean(e);
+			} else if (e.tag != tag) {
+				return false;
+			}
+			if (!m_sealed) {	//no writer or sweeping can happen when sealed
+				ReadLock lk(GET_LOCK(tag));
+				e.load_relaxed(ent);
+			}
+			if (UNLIKELY(IsEmpty(e))) {
+				return IsClean(e);
+			} else if (LIKELY(e.tag == tag && KeyMatch(key, BLK(e.blk)))) {
+				const auto val = RcVal(BLK(e.blk));
+				const size_t vlen = Rc(BLK(e.blk)).vlen;
+				if (UNLIKELY(vlen > max_val_len() || (size_t)(val - m_data) + vlen + m_const.extra
+					> (m_const.total_block << m_const.block_bits))) {
+					view.generation |= 1U;	//torn by writing, never valid
+					done = true;
+				} else if (!_expired(BLK(e.blk))) {
+					view.val = {val, vlen};
+					done = true;
+				}
+				return true;
+			}
+			return false;
+		}, code, (Entry*)m_table, m_const.total_entry);
+	};
+	search();
+	for (unsigned i = 0; !done && i < m_retry.times && UNLIKELY(_moving(view.generation)); i++) {
+		RECORD_COUNT(FETCH_RETRY, 1);
+		search();
+		if (done && UNLIKELY(m_stats != nullptr)) {
+			m_stats->add(StatsRecorder::FETCH_RETRY_HIT);
+		}
+	}
+	RECORD_STATS(done, FETCH_HIT, FETCH_MISS);
+	return done;
+}
+
+//reads of the value are ordered before the second load of generation, an odd one means
+//a write was in progress when the view was taken
+bool Estuary::view_valid(const View& view) const noexcept {
+	if (m_meta == nullptr || view.val.ptr == nullptr) {
+		return false;
+	}
+	if (m_sealed) {
+		return true;
+	}
+	AcquireFence();
+	return (view.generation & 1U) == 0 && LoadRelaxed(m_ext->generation) == view.generation;
+}
+
+//only part of value from offset (at most limit bytes) is copied
+//a sweep may be moving entries, or has moved some since generation was seen,
+//which is updated to the current one
+bool Estuary::_moving(uint64_t& generation) const {
+	AcquireFence();
+	const auto current = LoadRelaxed(m_ext->generation);
+	const bool moving = LoadRelaxed(m_meta->sweeping) || (current & 1U) != 0 || current != generation;
+	generation = current;
+	return moving;
+}
+
+bool Estuary::_fetch(Slice key, uint64_t code, std::string& out, uint64_t* stamp, uint64_t since,
+					 size_t offset, size_t limit) const {
+	if (m_sealed) {
+		return _fetch_sealed(key, code, out, stamp, since, offset, limit);
+	}
+	auto generation = LoadAcquire(m_ext->generation);
+	auto done = _fetch_once(key, code, out, stamp, since, offset, limit);
 #ifndef DISABLE_FETCH_RETRY
 	//entry can be moved at most twice during sweeping, witch may cause false missing
-	//NOTICE: it's not absolutely safe
-	if (!done && UNLIKELY(LoadRelaxed(m_meta->sweeping))) {
-		done = _fetch(key, out);
-		if (!done && UNLIKELY(LoadRelaxed(m_meta->sweeping))) {
-			done = _fetch(key, out);
+	//NOTICE: it's not absolutely safe when retries run out
+	for (unsigned i = 0; !done && i < m_retry.times && UNLIKELY(_moving(generation)); i++) {
+		if (m_retry.backoff_us != 0) {
+			std::this_thread::sleep_for(std::chrono::microseconds((uint64_t)m_retry.backoff_us << std::min(i, 20U)));
+		}
+		RECORD_COUNT(FETCH_RETRY, 1);
+		done = _fetch_once(key, code, out, stamp, since, offset, limit);
+		if (done && UNLIKELY(m_stats != nullptr)) {
+			m_stats->add(StatsRecorder::FETCH_RETRY_HIT);
 		}
 	}
 #endif
 	return done;
 }
 
-bool Estuary::_fetch(Slice key, std::string& out) const {
+//value will not be copied if record is not modified after since (0 means no condition)
+bool Estuary::_fetch_once(Slice key, uint64_t code, std::string& out, uint64_t* stamp, uint64_t since,
+						  size_t offset, size_t limit) const {
 	out.clear();
-	auto code = Hash(key.ptr, key.len, m_const.seed);
 	struct {
 		uint32_t tag = 0;
 		uint32_t val_len = UINT32_MAX;
 		const Entry* ent = nullptr;
 	} snapshot;
 	static_assert(UINT32_MAX > MAX_VAL_LEN);
-	SearchInTable([this, key, &snapshot, &out](Entry& ent, uint32_t tag)->bool{
+	auto read_stamp = [this, stamp](uint8_t* block) {
+		if (stamp != nullptr) {
+			*stamp = HAS_STAMP? *(const uint64_t*)RcExtra(block) : 0;
+		}
+	};
+	auto unmodified = [this, since](uint8_t* block)->bool {
+		return since != 0 && *(const uint64_t*)RcExtra(block) <= since;
+	};
+	auto piece = [offset, limit](uint8_t* block)->Slice {
+		const size_t len = Rc(block).vlen;
+		const auto off = std::min(offset, len);
+		return {RcVal(block) + off, std::min(limit, len - off)};
+	};
+	SearchInTable([this, key, &snapshot, &out, &read_stamp, &unmodified, &piece](Entry& ent, uint32_t tag)->bool{
 		auto e = ent;
 		if (IsEmpty(e)) {
 			return IsClean(e);
@@ -252,12 +677,22 @@ bool Estuary::_fetch(Slice key, std::string& out) const {
 			if (UNLIKELY(IsEmpty(e))) {
 				return IsClean(e);
 			} else if (LIKELY(e.tag == tag && KeyMatch(key, BLK(e.blk)))) {
-				snapshot.val_len = Rc(BLK(e.blk)).vlen;
+				if (UNLIKELY(_expired(BLK(e.blk)))) {
+					return true;
+				}
+				if (UNLIKELY(unmodified(BLK(e.blk)))) {
+					snapshot.val_len = 0;
+					read_stamp(BLK(e.blk));
+					return true;
+				}
+				const auto val = piece(BLK(e.blk));
+				snapshot.val_len = val.len;
 				if (out.capacity() < snapshot.val_len) {
 					snapshot.ent = &ent;
 					snapshot.tag = tag;
 				} else {
-					out.assign(reinterpret_cast<const char*>(RcVal(BLK(e.blk))), snapshot.val_len);
+					out.assign(reinterpret_cast<const char*>(val.ptr), val.len);
+					read_stamp(BLK(e.blk));
 				}
 				return true;
 			}
@@ -273,22 +708,57 @@ bool Estuary::_fetch(Slice key, std::string& out) const {
 		ReadLock lk(GET_LOCK(snapshot.tag));
 		e.load_relaxed(*snapshot.ent);
 		if (LIKELY(!IsEmpty(e) && e.tag == snapshot.tag && KeyMatch(key, BLK(e.blk)))) {
-			snapshot.val_len = Rc(BLK(e.blk)).vlen;
-			if (UNLIKELY(out.capacity() < snapshot.val_len)) {
+			if (UNLIKELY(_expired(BLK(e.blk)))) {
+				return false;
+			}
+			if (UNLIKELY(unmodified(BLK(e.blk)))) {
+				read_stamp(BLK(e.blk));
+				return true;
+			}
+			const auto val = piece(BLK(e.blk));
+			snapshot.val_len = val.len;
+			if (UNLIKELY(out.capacity() < snapshot.val_len)) {	//value grew under us
+				RECORD_COUNT(FETCH_RETRY, 1);
 				continue;
 			}
-			out.assign(reinterpret_cast<const char*>(RcVal(BLK(e.blk))), snapshot.val_len);
+			out.assign(reinterpret_cast<const char*>(val.ptr), val.len);
+			read_stamp(BLK(e.blk));
 			return true;
 		}
 		return false;
 	}
 }
 
-static FORCE_INLINE RecordMark MarkForEmpty(size_t bcnt) {
-	RecordMark mark;
-	mark.klen = 0;
-	mark.bcnt = bcnt;
-	return mark;
+//no writer or sweeping can happen when sealed
+bool Estuary::_fetch_sealed(Slice key, uint64_t code, std::string& out, uint64_t* stamp, uint64_t since,
+							size_t offset, size_t limit) const {
+	out.clear();
+	bool done = false;
+	SearchInTable([this, key, &out, stamp, since, offset, limit, &done](Entry& ent, uint32_t tag)->bool{
+		const auto e = ent;
+		if (IsEmpty(e)) {
+			return IsClean(e);
+		} else if (e.tag == tag && KeyMatch(key, BLK(e.blk))) {
+			auto block = BLK(e.blk);
+			if (_expired(block)) {
+				return true;
+			}
+			const uint64_t mtime = HAS_STAMP? *(const uint64_t*)RcExtra(block) : 0;
+			if (stamp != nullptr) {
+				*stamp = mtime;
+			}
+			if (since == 0 || mtime > since) {
+				const size_t len = Rc(block).vlen;
+				const auto off = std::min(offset, len);
+				out.assign(reinterpret_cast<const char*>(RcVal(block) + off), std::min(limit, len - off));
+			}
+			done = true;
+			return true;
+		}
+		return false;
+	}, code, m_sparse.table != nullptr? (Entry*)m_sparse.table.get() : (Entry*)m_table,
+		m_sparse.table != nullptr? m_sparse.total_entry : m_const.total_entry);
+	return done;
 }
 
 static FORCE_INLINE void UpdateEntry(SharedMutex* lock, Entry& ent, const Entry val) {
@@ -297,20 +767,55 @@ static FORCE_INLINE void UpdateEntry(SharedMutex* lock, Entry& ent, const Entry
 }
 
 bool Estuary::erase(Slice key) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+		return {};
+	}
+	return erase_hashed(HASH(key.ptr, key.len), key);
+}
+
+bool Estuary::erase_hashed(uint64_t code, Slice key) const {
 	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
 		return {};
 	}
+#ifdef ENABLE_CONSISTENCY_CHECK
+	ConsistencyAssert(code == HASH(key.ptr, key.len));
+#endif
+	return _try_erase(code, key) == Error::OK;
+}
+
+Estuary::Error Estuary::try_erase(Slice key) const {
+	CANONICAL_KEY(key);
+	auto err = _check(key, nullptr);
+	if (err != Error::OK) {
+		return err;
+	}
+	return _try_erase(HASH(key.ptr, key.len), key);
+}
+
+Estuary::Error Estuary::_try_erase(uint64_t code, Slice key) const {
+	TIME_IT(WRITE);
+	AUDIT(ERASE, key, 0);
 	MutexLock master_lock(&m_locks->master);
 	if (m_meta->writing) {
 		throw DataException();
 	}
-	m_meta->writing = true;
-	auto done = _erase(key);
-	m_meta->writing = false;
-	return done;
+	if (m_sealed || m_ext->frozen) {
+		RECORD_STATS(false, ERASE, REJECT);
+		return Error::FROZEN;
+	}
+	_begin_write();
+	auto done = _erase(key, code);
+	_end_write();
+	if (done && m_stats != nullptr) {
+		m_stats->add(StatsRecorder::ERASE);
+	}
+	_auditor.set(AuditEvent::ERASE, done, 0);
+	return done? Error::OK : Error::NOT_FOUND;
 }
 
-bool Estuary::_erase(Slice key) const {
+//expired item is removed too, but not reported as erased
+bool Estuary::_erase(Slice key, uint64_t code) const {
 	bool done = false;
 	SearchInTable([this, key, &done](Entry& ent, uint32_t tag)->bool{
 			const auto e = ent;
@@ -320,285 +825,1575 @@ bool Estuary::_erase(Slice key) const {
 				auto block = BLK(e.blk);
 				ConsistencyAssert(Rc(block).klen != 0 && Rc(block).vlen <= max_val_len());
 				if (LIKELY(KeyMatch(key, block))) {
+					done = !_expired(block);
 					UpdateEntry(GET_LOCK(tag), ent, DELETED_ENTRY);
 					ConsistencyAssert(m_meta->item != 0);
 					m_meta->item--;
-					const auto bcnt = RecordBlocks(block);
+					const auto bcnt = RecordBlocks(block, m_const.extra, m_const.block_bits);
 					Rc(block) = MarkForEmpty(bcnt);
 					m_meta->free_block += bcnt;
 					ConsistencyAssert(m_meta->free_block <= m_const.total_block);
-					done = true;
 					return true;
 				}
 			}
 			return false;
-		}, Hash(key.ptr, key.len, m_const.seed), (Entry*)m_table, m_const.total_entry);
+		}, code, (Entry*)m_table, m_const.total_entry);
 	return done;
 }
 
-static void FillRecord(uint8_t* block, Slice key, Slice val) {
-	//mark should be updated atomically
-	RecordMark mark;
-	mark.klen = key.len;
-	mark.vlen = val.len;
-	for (unsigned i = 0; i < 4; i++) {
-		if (LIKELY(key.len > 0)) {
-			mark.part[i] = *key.ptr++;
-			key.len--;
-		} else if (val.len > 0) {
-			mark.part[i] = *val.ptr++;
-			val.len--;
+
+//remove item of a live entry found without searching by key
+void Estuary::_drop(size_t pos) const {
+	auto& ent = ((Entry*)m_table)[pos];
+	const auto e = ent;
+	auto block = BLK(e.blk);
+	UpdateEntry(GET_LOCK(e.tag), ent, DELETED_ENTRY);
+	ConsistencyAssert(m_meta->item != 0);
+	m_meta->item--;
+	const auto bcnt = RecordBlocks(block, m_const.extra, m_const.block_bits);
+	Rc(block) = MarkForEmpty(bcnt);
+	m_meta->free_block += bcnt;
+	ConsistencyAssert(m_meta->free_block <= m_const.total_block);
+}
+
+size_t Estuary::expire_sweep(size_t limit) const {
+	if (m_meta == nullptr || !HAS_TTL || limit == 0) {
+		return 0;
+	}
+	MutexLock master_lock(&m_locks->master);
+	if (m_meta->writing) {
+		throw DataException();
+	}
+	if (m_sealed || m_ext->frozen) {
+		return 0;
+	}
+	_begin_write();
+	const auto total = m_const.total_entry.value();
+	auto table = (const Entry*)m_table;
+	auto& cursor = m_ext->expire_cursor;
+	if (cursor >= total) {
+		cursor = 0;
+	}
+	size_t cnt = 0;
+	for (size_t i = 0; i < limit && i < total; i++) {
+		const auto e = table[cursor];
+		if (!IsEmpty(e) && _expired(BLK(e.blk))) {
+			_drop(cursor);
+			cnt++;
+		}
+		if (++cursor == total) {
+			cursor = 0;
+		}
+	}
+	_end_write();
+	return cnt;
+}
+
+bool Estuary::update(Slice key, Slice val) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr
+		|| key.ptr == nullptr || key.len == 0 || key.len > max_key_len()
+		|| (val.len != 0 && val.ptr == nullptr) || val.len > max_val_len()) {
+		return false;
+	}
+	return update_hashed(HASH(key.ptr, key.len), key, val);
+}
+
+bool Estuary::update_hashed(uint64_t code, Slice key, Slice val) const {
+	if (m_meta == nullptr
+		|| key.ptr == nullptr || key.len == 0 || key.len > max_key_len()
+		|| (val.len != 0 && val.ptr == nullptr) || val.len > max_val_len()) {
+		return false;
+	}
+#ifdef ENABLE_CONSISTENCY_CHECK
+	ConsistencyAssert(code == HASH(key.ptr, key.len));
+#endif
+	return _try_update(code, key, val) == Error::OK;
+}
+
+Estuary::Error Estuary::try_update(Slice key, Slice val) const {
+	CANONICAL_KEY(key);
+	auto err = _check(key, &val);
+	if (err != Error::OK) {
+		return err;
+	}
+	return _try_update(HASH(key.ptr, key.len), key, val);
+}
+
+Estuary::Error Estuary::_try_update(uint64_t code, Slice key, Slice val) const {
+	TIME_IT(WRITE);
+	AUDIT(UPDATE, key, val.len);
+	if (m_validator != nullptr && !m_validator(key, val)) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::INVALID);
+		return Error::INVALID;
+	}
+	MutexLock master_lock(&m_locks->master);
+	if (m_meta->writing) {
+		throw DataException();
+	}
+	if (m_sealed || m_ext->frozen) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::FROZEN);
+		return Error::FROZEN;
+	}
+	_begin_write();
+	auto done = _update(key, code, val);
+	_end_write();
+	RECORD_STATS(done, UPDATE, REJECT);
+	if (!done) {
+		REPORT_REJECT(key, m_reject);
+	}
+	_auditor.set(AuditEvent::UPDATE, done, val.len);
+	return done? Error::OK : m_reject;
+}
+
+bool Estuary::update_ttl(Slice key, Slice val, std::chrono::microseconds ttl) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || !HAS_TTL || ttl.count() <= 0
+		|| key.ptr == nullptr || key.len == 0 || key.len > max_key_len()
+		|| (val.len != 0 && val.ptr == nullptr) || val.len > max_val_len()) {
+		return false;
+	}
+	TIME_IT(WRITE);
+	AUDIT(UPDATE, key, val.len);
+	if (m_validator != nullptr && !m_validator(key, val)) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::INVALID);
+		return false;
+	}
+	MutexLock master_lock(&m_locks->master);
+	if (m_meta->writing) {
+		throw DataException();
+	}
+	if (m_sealed || m_ext->frozen) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::FROZEN);
+		return false;
+	}
+	_begin_write();
+	auto done = _update(key, HASH(key.ptr, key.len), val, nullptr, Clock::Now() + ttl.count());
+	_end_write();
+	RECORD_STATS(done, UPDATE, REJECT);
+	if (!done) {
+		REPORT_REJECT(key, m_reject);
+	}
+	_auditor.set(AuditEvent::UPDATE, done, val.len);
+	return done;
+}
+
+bool Estuary::touch(Slice key, std::chrono::microseconds ttl) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || !HAS_TTL || ttl.count() < 0
+		|| key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+		return false;
+	}
+	const auto code = HASH(key.ptr, key.len);
+	TIME_IT(WRITE);
+	AUDIT(UPDATE, key, 0);
+	MutexLock master_lock(&m_locks->master);
+	if (m_meta->writing) {
+		throw DataException();
+	}
+	if (m_sealed || m_ext->frozen) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::FROZEN);
+		return false;
+	}
+	_begin_write();
+	const uint64_t expiry = ttl.count() == 0? 0 : Clock::Now() + ttl.count();
+	bool done = false;
+	size_t vlen = 0;
+	SearchInTable([this, key, expiry, &done, &vlen](Entry& ent, uint32_t tag)->bool{
+			const auto e = ent;
+			if (IsEmpty(e)) {
+				return IsClean(e);
+			} else if (e.tag == tag) {
+				auto block = BLK(e.blk);
+				if (LIKELY(KeyMatch(key, block))) {
+					if (!_expired(block)) {
+						WriteLock _(GET_LOCK(tag));
+						EXPIRY(block) = expiry;
+						vlen = Rc(block).vlen;
+						done = true;
+					}
+					return true;
+				}
+			}
+			return false;
+		}, code, (Entry*)m_table, m_const.total_entry);
+	_end_write();
+	if (done) {
+		if (m_stats != nullptr) {
+			m_stats->add(StatsRecorder::UPDATE);
+		}
+	}
+	_auditor.set(AuditEvent::UPDATE, done, vlen);
+	return done;
+}
+
+bool Estuary::update(Slice key, Slice val, Deadline deadline) const {
+	return try_update(key, val, deadline) == Error::OK;
+}
+
+Estuary::Error Estuary::try_update(Slice key, Slice val, Deadline deadline) const {
+	CANONICAL_KEY(key);
+	auto err = _check(key, &val);
+	if (err != Error::OK) {
+		return err;
+	}
+	TIME_IT(WRITE);
+	AUDIT(UPDATE, key, val.len);
+	if (m_validator != nullptr && !m_validator(key, val)) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::INVALID);
+		return Error::INVALID;
+	}
+	const auto ns = std::chrono::duration_cast<std::chrono::nanoseconds>(deadline.time_since_epoch()).count();
+	timespec ts;
+	ts.tv_sec = ns / 1000000000LL;
+	ts.tv_nsec = ns % 1000000000LL;
+	if (ts.tv_nsec < 0) {
+		ts.tv_sec--;
+		ts.tv_nsec += 1000000000LL;
+	}
+	auto ret = pthread_mutex_timedlock(&m_locks->master, &ts);
+	if (ret == ETIMEDOUT) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::TIMEOUT);
+		return Error::TIMEOUT;
+	} else if (UNLIKELY(ret != 0)) {
+		throw LockException();
+	}
+	MutexLock master_lock(&m_locks->master, std::adopt_lock);
+	if (m_meta->writing) {
+		throw DataException();
+	}
+	if (m_sealed || m_ext->frozen) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::FROZEN);
+		return Error::FROZEN;
+	}
+	_begin_write();
+	auto done = _update(key, HASH(key.ptr, key.len), val, &deadline);
+	_end_write();
+	RECORD_STATS(done, UPDATE, REJECT);
+	if (!done) {
+		REPORT_REJECT(key, m_reject);
+	}
+	_auditor.set(AuditEvent::UPDATE, done, val.len);
+	return done? Error::OK : m_reject;
+}
+
+static Estuary::AuditEvent MakeAuditEvent(Estuary::AuditEvent::Op op, Slice key, size_t size, bool done,
+										   std::chrono::steady_clock::time_point start) {
+	Estuary::AuditEvent event;
+	event.op = op;
+	event.key_hash = Hash(key.ptr, key.len, 0);
+	event.size = size;
+	event.done = done;
+	event.latency_ns = std::chrono::duration_cast<std::chrono::nanoseconds>(
+			std::chrono::steady_clock::now() - start).count();
+	event.time = std::chrono::system_clock::now();
+	return event;
+}
+
+size_t Estuary::update_batch(const std::vector<IDataReader::Record>& items, std::vector<bool>& done) const {
+	done.assign(items.size(), false);
+	if (m_meta == nullptr) {
+		return 0;
+	}
+	std::vector<AuditEvent> events;
+	size_t cnt = 0;
+	{
+		MutexLock master_lock(&m_locks->master);
+		if (m_meta->writing) {
+			throw DataException();
+		}
+		const bool frozen = m_sealed || m_ext->frozen;
+		for (size_t i = 0; i < items.size(); i++) {
+			auto rec = items[i];
+			if (m_key_transform != nullptr && rec.key.ptr != nullptr) {
+				m_key_transform(rec.key, m_key_scratch);
+				rec.key = {(const uint8_t*)m_key_scratch.data(), m_key_scratch.size()};
+			}
+			const auto start = std::chrono::steady_clock::now();
+			auto reason = frozen? Error::FROZEN : Error::INVALID;
+			if (!frozen && rec.key.ptr != nullptr && rec.key.len != 0 && rec.key.len <= max_key_len()
+				&& (rec.val.len == 0 || rec.val.ptr != nullptr) && rec.val.len <= max_val_len()
+				&& (m_validator == nullptr || m_validator(rec.key, rec.val))) {
+				_begin_write();
+				done[i] = _update(rec.key, HASH(rec.key.ptr, rec.key.len), rec.val);
+				_end_write();
+				reason = m_reject;
+			}
+			RECORD_STATS(done[i], UPDATE, REJECT);
+			if (!done[i]) {
+				REPORT_REJECT(rec.key, reason);
+			}
+			if (m_audit != nullptr && rec.key.ptr != nullptr) {
+				events.push_back(MakeAuditEvent(AuditEvent::UPDATE, rec.key, rec.val.len, done[i], start));
+			}
+			cnt += done[i];
+		}
+	}
+	//out of master lock
+	for (auto& event : events) {
+		m_audit(event);
+	}
+	return cnt;
+}
+
+size_t Estuary::erase_batch(const std::vector<Slice>& keys, std::vector<bool>& done) const {
+	done.assign(keys.size(), false);
+	if (m_meta == nullptr) {
+		return 0;
+	}
+	std::vector<AuditEvent> events;
+	size_t cnt = 0;
+	{
+		MutexLock master_lock(&m_locks->master);
+		if (m_meta->writing) {
+			throw DataException();
+		}
+		const bool frozen = m_sealed || m_ext->frozen;
+		for (size_t i = 0; i < keys.size(); i++) {
+			auto key = keys[i];
+			if (m_key_transform != nullptr && key.ptr != nullptr) {
+				m_key_transform(key, m_key_scratch);
+				key = {(const uint8_t*)m_key_scratch.data(), m_key_scratch.size()};
+			}
+			if (key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+				continue;
+			}
+			const auto start = std::chrono::steady_clock::now();
+			if (frozen) {
+				RECORD_STATS(false, ERASE, REJECT);
+			} else {
+				_begin_write();
+				done[i] = _erase(key, HASH(key.ptr, key.len));
+				_end_write();
+				if (done[i] && m_stats != nullptr) {
+					m_stats->add(StatsRecorder::ERASE);
+				}
+			}
+			if (m_audit != nullptr) {
+				events.push_back(MakeAuditEvent(AuditEvent::ERASE, key, 0, done[i], start));
+			}
+			cnt += done[i];
+		}
+	}
+	//out of master lock
+	for (auto& event : events) {
+		m_audit(event);
+	}
+	return cnt;
+}
+
+size_t Estuary::ingest(IDataReader& source, const IngestOptions& options) const {
+	return _ingest(source, options, false);
+}
+
+size_t Estuary::_ingest(IDataReader& source, const IngestOptions& options, bool canonical) const {
+	if (m_meta == nullptr) {
+		return 0;
+	}
+	source.reset();
+	const auto total = source.total();
+	const auto batch = std::max(options.batch, 1U);
+	std::vector<AuditEvent> events;
+	std::string key_buf;
+	size_t cnt = 0;
+	for (size_t i = 0; i < total; ) {
+		bool stop = false;
+		{
+			MutexLock master_lock(&m_locks->master);
+			if (m_meta->writing) {
+				throw DataException();
+			}
+			if (m_sealed || m_ext->frozen) {
+				return cnt;
+			}
+			for (const auto end = std::min(i+batch, total); i < end; i++) {
+				auto rec = source.read();
+				if (!canonical && m_key_transform != nullptr && rec.key.ptr != nullptr) {
+					m_key_transform(rec.key, key_buf);
+					rec.key = {(const uint8_t*)key_buf.data(), key_buf.size()};
+				}
+				bool done = false;
+				const auto start = std::chrono::steady_clock::now();
+				auto reason = Error::INVALID;
+				if (rec.key.ptr != nullptr && rec.key.len != 0 && rec.key.len <= max_key_len()
+					&& (rec.val.len == 0 || rec.val.ptr != nullptr) && rec.val.len <= max_val_len()
+					&& (m_validator == nullptr || m_validator(rec.key, rec.val))) {
+					_begin_write();
+					done = _update(rec.key, HASH(rec.key.ptr, rec.key.len), rec.val);
+					_end_write();
+					reason = m_reject;
+				}
+				RECORD_STATS(done, UPDATE, REJECT);
+				if (!done) {
+					REPORT_REJECT(rec.key, reason);
+				}
+				if (m_audit != nullptr && rec.key.ptr != nullptr) {
+					events.push_back(MakeAuditEvent(AuditEvent::UPDATE, rec.key, rec.val.len, done, start));
+				}
+				if (done) {
+					cnt++;
+				} else if (options.stop_on_failure) {
+					stop = true;
+					i++;
+					break;
+				}
+			}
+		}
+		//out of master lock
+		for (auto& event : events) {
+			m_audit(event);
+		}
+		events.clear();
+		if (options.progress != nullptr) {
+			options.progress(i, total);
+		}
+		if (stop) {
+			break;
+		}
+	}
+	return cnt;
+}
+
+//overwrite the record of existing key if block count is unchanged
+bool Estuary::_update_in_place(Slice key, uint64_t code, Slice val, uint64_t expiry) const {
+	bool done = false;
+	SearchInTable([this, key, val, expiry, &done](Entry& ent, uint32_t tag)->bool{
+			const auto e = ent;
+			if (IsEmpty(e)) {
+				return IsClean(e);
+			} else if (e.tag == tag) {
+				auto block = BLK(e.blk);
+				ConsistencyAssert(Rc(block).klen != 0 && Rc(block).vlen <= max_val_len());
+				if (LIKELY(KeyMatch(key, block))) {
+					const auto bcnt = RecordBlocks(block, m_const.extra, m_const.block_bits);
+					if (bcnt == RecordBlocks(key.len, val.len, m_const.extra, m_const.block_bits)) {
+						if (ValMatch(val, block) && !HAS_TTL) {	//nothing to write
+							m_unchanged = true;
+							done = true;
+							return true;
+						}
+						const auto neo_expiry = expiry == KEEP_EXPIRY? _inherit_expiry(block) : expiry;
+						WriteLock _(GET_LOCK(tag));
+						FillRecord(block, key, val);
+						_fill_extra(block, neo_expiry);
+						RECORD_COUNT(LOGICAL_BYTE, key.len + val.len);
+						RECORD_COUNT(DATA_BYTE, bcnt << m_const.block_bits);
+						done = true;
+					}
+					return true;
+				}
+			}
+			return false;
+		}, code, (Entry*)m_table, m_const.total_entry);
+	return done;
+}
+
+template <typename Func>
+bool Estuary::_modify(Slice key, const Func& func, const bool* unchanged) const {
+	TIME_IT(WRITE);
+	AUDIT(UPDATE, key, 0);
+	MutexLock master_lock(&m_locks->master);
+	if (m_meta->writing) {
+		throw DataException();
+	}
+	if (m_sealed || m_ext->frozen) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::FROZEN);
+		return false;
+	}
+	const auto code = HASH(key.ptr, key.len);
+	auto& val = m_scratch;
+	const bool existed = _fetch(key, code, val, nullptr, 0);
+	bool exists = existed;
+	if (!func(val, exists)) {
+		_auditor.cancel();
+		return false;
+	}
+	if (unchanged != nullptr && *unchanged) {
+		_auditor.cancel();
+		return true;
+	}
+	if (!exists) {
+		if (!existed) {
+			_auditor.cancel();
+			return true;
+		}
+		_begin_write();
+		auto done = _erase(key, code);
+		_end_write();
+		RECORD_STATS(done, ERASE, REJECT);
+		_auditor.set(AuditEvent::ERASE, done, 0);
+		return done;
+	}
+	Slice tmp = {(const uint8_t*)val.data(), val.size()};
+	if (val.size() > max_val_len() || (m_validator != nullptr && !m_validator(key, tmp))) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::INVALID);
+		return false;
+	}
+	_begin_write();
+	auto done = _update(key, code, tmp, nullptr, KEEP_EXPIRY);
+	_end_write();
+	RECORD_STATS(done, UPDATE, REJECT);
+	if (!done) {
+		REPORT_REJECT(key, m_reject);
+	}
+	_auditor.set(AuditEvent::UPDATE, done, val.size());
+	return done;
+}
+
+//a set is encoded as members with 16-bit length prefix
+static size_t SetFind(const std::string& set, Slice member) {
+	for (size_t off = 0; off + sizeof(uint16_t) <= set.size(); ) {
+		const auto len = *(const uint16_t*)(set.data()+off);
+		const auto next = off + sizeof(uint16_t) + len;
+		if (next > set.size()) {
+			break;
+		}
+		if (len == member.len && memcmp(set.data()+off+sizeof(uint16_t), member.ptr, len) == 0) {
+			return off;
+		}
+		off = next;
+	}
+	return std::string::npos;
+}
+
+bool Estuary::add_to_set(Slice key, Slice member) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()
+		|| (member.len != 0 && member.ptr == nullptr) || member.len > UINT16_MAX) {
+		return false;
+	}
+	bool unchanged = false;
+	return _modify(key, [member, &unchanged](std::string& val, bool& exists)->bool {
+		if (!exists) {
+			val.clear();
+			exists = true;
+		} else if (SetFind(val, member) != std::string::npos) {
+			unchanged = true;	//already a member
+			return true;
+		}
+		const uint16_t len = member.len;
+		val.append((const char*)&len, sizeof(len));
+		val.append((const char*)member.ptr, member.len);
+		return true;
+	}, &unchanged);
+}
+
+bool Estuary::remove_from_set(Slice key, Slice member) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()
+		|| (member.len != 0 && member.ptr == nullptr) || member.len > UINT16_MAX) {
+		return false;
+	}
+	return _modify(key, [member](std::string& val, bool& exists)->bool {
+		if (!exists) {
+			return false;
+		}
+		auto off = SetFind(val, member);
+		if (off == std::string::npos) {
+			return false;
+		}
+		val.erase(off, sizeof(uint16_t) + member.len);
+		exists = !val.empty();
+		return true;
+	});
+}
+
+bool Estuary::members(Slice key, std::vector<std::string>& out) const {
+	CANONICAL_KEY(key);
+	out.clear();
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+		return false;
+	}
+	std::string val;
+	if (!fetch_hashed(HASH(key.ptr, key.len), key, val)) {	//key is transformed already
+		return false;
+	}
+	for (size_t off = 0; off + sizeof(uint16_t) <= val.size(); ) {
+		const auto len = *(const uint16_t*)(val.data()+off);
+		off += sizeof(uint16_t);
+		if (off + len > val.size()) {
+			return false;
+		}
+		out.emplace_back(val.data()+off, len);
+		off += len;
+	}
+	return true;
+}
+
+bool Estuary::update_with(Slice key, const Updater& func) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || !func || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+		return false;
+	}
+	return _modify(key, [&func](std::string& val, bool& exists)->bool {
+		if (!func(val, exists)) {
+			return false;
+		}
+		exists = true;
+		return true;
+	});
+}
+
+bool Estuary::patch_value(Slice key, size_t offset, Slice patch) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()
+		|| (patch.len != 0 && patch.ptr == nullptr) || patch.len > max_val_len()
+		|| offset > max_val_len() - patch.len) {
+		return false;
+	}
+	const auto code = HASH(key.ptr, key.len);
+	TIME_IT(WRITE);
+	AUDIT(UPDATE, key, 0);
+	MutexLock master_lock(&m_locks->master);
+	if (m_meta->writing) {
+		throw DataException();
+	}
+	if (m_sealed || m_ext->frozen) {
+		RECORD_STATS(false, UPDATE, REJECT);
+		REPORT_REJECT(key, Error::FROZEN);
+		return false;
+	}
+	uint8_t* target = nullptr;
+	uint32_t tag = 0;
+	SearchInTable([this, key, &target, &tag](Entry& ent, uint32_t t)->bool{
+			const auto e = ent;
+			if (IsEmpty(e)) {
+				return IsClean(e);
+			} else if (e.tag == t) {
+				auto block = BLK(e.blk);
+				if (LIKELY(KeyMatch(key, block))) {
+					if (!_expired(block)) {
+						target = block;
+						tag = t;
+					}
+					return true;
+				}
+			}
+			return false;
+		}, code, (Entry*)m_table, m_const.total_entry);
+	if (target == nullptr || offset + patch.len > Rc(target).vlen) {
+		_auditor.cancel();
+		return false;
+	}
+	const size_t vlen = Rc(target).vlen;
+	if (m_validator != nullptr) {
+		auto& val = m_scratch;
+		val.assign((const char*)RcVal(target), vlen);
+		memcpy(&val[offset], patch.ptr, patch.len);
+		if (!m_validator(key, {(const uint8_t*)val.data(), val.size()})) {
+			RECORD_STATS(false, UPDATE, REJECT);
+			REPORT_REJECT(key, Error::INVALID);
+			_auditor.set(AuditEvent::UPDATE, false, vlen);
+			return false;
+		}
+	}
+	_begin_write();
+	if (patch.len != 0) {	//readers are kept out like overwriting the whole record in place
+		WriteLock _(GET_LOCK(tag));
+		memcpy(RcVal(target) + offset, patch.ptr, patch.len);
+		_fill_extra(target, _inherit_expiry(target));
+	}
+	_end_write();
+	RECORD_STATS(true, UPDATE, REJECT);
+	RECORD_COUNT(LOGICAL_BYTE, patch.len);
+	RECORD_COUNT(DATA_BYTE, patch.len);
+	_auditor.set(AuditEvent::UPDATE, true, vlen);
+	return true;
+}
+
+bool Estuary::append(Slice key, Slice suffix) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()
+		|| (suffix.len != 0 && suffix.ptr == nullptr) || suffix.len > max_val_len()) {
+		return false;
+	}
+	return _modify(key, [suffix](std::string& val, bool& exists)->bool {
+		if (!exists) {
+			val.clear();
+			exists = true;
+		}
+		val.append((const char*)suffix.ptr, suffix.len);
+		return true;
+	});
+}
+
+bool Estuary::add(Slice key, int64_t delta, int64_t& result) const {
+	CANONICAL_KEY(key);
+	if (m_meta == nullptr || max_val_len() < sizeof(int64_t)
+		|| key.ptr == nullptr || key.len == 0 || key.len > max_key_len()) {
+		return false;
+	}
+	int64_t sum = 0;
+	auto done = _modify(key, [delta, &sum](std::string& val, bool& exists)->bool {
+		if (!exists) {
+			val.assign(sizeof(int64_t), '\0');
+			exists = true;
+		} else if (val.size() != sizeof(int64_t)) {
+			return false;
+		}
+		int64_t num;
+		memcpy(&num, val.data(), sizeof(num));
+		sum = (int64_t)((uint64_t)num + (uint64_t)delta);	//wrap around on overflow
+		memcpy(&val[0], &sum, sizeof(sum));
+		return true;
+	});
+	if (done) {
+		result = sum;
+	}
+	return done;
+}
+
+bool Estuary::get_set(Slice key, Slice val, std::string& old, bool& existed) const {
+	CANONICAL_KEY(key);
+	old.clear();
+	existed = false;
+	if (m_meta == nullptr || key.ptr == nullptr || key.len == 0 || key.len > max_key_len()
+		|| (val.len != 0 && val.ptr == nullptr) || val.len > max_val_len()) {
+		return false;
+	}
+	return _modify(key, [val, &old, &existed](std::string& cur, bool& exists)->bool {
+		existed = exists;
+		if (exists) {
+			old.swap(cur);
+		}
+		cur.assign((const char*)val.ptr, val.len);
+		exists = true;
+		return true;
+	});
+}
+
+#define TOTAL_RESERVED_BLOCK (m_const.reserved_block + (m_const.total_block-m_const.reserved_block)/m_const.data_reserve)
+
+size_t Estuary::data_free() const {
+	if (m_meta == nullptr) return 0;
+	ConsistencyAssert(m_meta->free_block >= TOTAL_RESERVED_BLOCK);
+	return (m_meta->free_block - TOTAL_RESERVED_BLOCK) << m_const.block_bits;
+}
+size_t Estuary::item_limit() const {
+	if (m_meta == nullptr) return 0;
+	return ItemLimit(m_const.total_entry.value());
+}
+
+//separated to be recognizable in profiling
+NOINLINE void Estuary::_sweep() const {
+	//x times random input brings 1-1/e^x coverage，x = ln(entry reserve factor)
+	//this procedure is slow, but rarely happen
+	//TODO: need better algorithm
+	auto get_hash_code = [this](Entry entry)->uint64_t {
+		auto block = BLK(entry.blk);
+		const auto code = HASH(RcKey(block), Rc(block).klen);
+		ConsistencyAssert(entry.tag == (code>>(64U - TAG_BITWIDTH)));
+		return code;
+	};
+
+	auto table = (Entry*)m_table;
+	auto& total_entry = m_const.total_entry;
+	auto upstairs = [table, &total_entry, &get_hash_code](bool end)->bool {
+		bool moved = false;
+		for (size_t i = 0; i < total_entry.value(); i++) {
+			if (LIKELY(IsEmpty(table[i]) || table[i].fit)) {
+				continue;
+			}
+			bool fit = true;
+			auto curr = &table[i];
+			SearchInTable([&fit, &moved, curr, end](Entry& ent, uint32_t tag)->bool{
+				if (IsEmpty(ent)) {
+					moved = true;
+					ConsistencyAssert(!IsClean(ent));
+					ent = *curr;
+					if (fit) {
+						ent.fit = 1;
+					}
+					curr->store_release(DELETED_ENTRY);
+					if (end) {
+						curr->fit = 1;
+					}
+					return true;
+				} else if (!ent.fit) {
+					if (&ent == curr) {
+						//settled only when nothing ahead may move, or an entry ahead
+						//moving away later leaves a clean hole in the probe chain
+						if (fit) {
+							curr->fit = 1;
+						}
+						return true;
+					}
+					fit = false;
+				}
+				return false;
+			}, get_hash_code(*curr), table, total_entry);
+		}
+		return moved;
+	};
+
+	//entry can be moved twice at most
+	m_meta->sweeping = true;
+	MemoryBarrier();
+	if (upstairs(false)) {
+		upstairs(true);
+	}
+
+	size_t dirty = 0;
+	size_t item = 0;
+	for (size_t i = 0; i < total_entry.value(); i++) {
+		if (IsEmpty(table[i])) {
+			if (table[i].fit) {
+				dirty++;
+				table[i].fit = 0;
+			} else {
+				table[i] = CLEAN_ENTRY;
+			}
+		} else {
+			item++;
+			table[i].fit = 0;
+		}
+	}
+
+	//keep sweeping status longer
+	MemoryBarrier();
+	m_meta->sweeping = false;
+
+	ConsistencyAssert(item == m_meta->item);
+	m_meta->clean_entry = total_entry.value() - item - dirty;
+	m_ext->swept_dirty = dirty;
+}
+
+void Estuary::set_tombstone_limit(double ratio) noexcept {
+	if (ratio <= 0.0) {
+		m_tombstone_limit = 0;
+	} else {
+		m_tombstone_limit = std::max<size_t>(1, std::min(ratio, 1.0) * m_const.total_entry.value());
+	}
+}
+
+void Estuary::set_eviction(unsigned samples) noexcept {
+	m_evict_samples = samples;
+	if (m_evict_rnd == 0) {
+		m_evict_rnd = Clock::Seed() | 1U;
+	}
+}
+
+bool Estuary::_evict() const {
+	const auto total = m_const.total_entry.value();
+	auto table = (const Entry*)m_table;
+	size_t victim = SIZE_MAX;
+	uint64_t oldest = UINT64_MAX;
+	for (unsigned i = 0; i < m_evict_samples && m_meta->item != 0; i++) {
+		m_evict_rnd = m_evict_rnd * 6364136223846793005ULL + 1442695040888963407ULL;
+		auto pos = (m_evict_rnd >> 16U) % total;
+		while (IsEmpty(table[pos])) {	//there is at least one item
+			if (++pos == total) {
+				pos = 0;
+			}
+		}
+		auto block = BLK(table[pos].blk);
+		if (_expired(block)) {
+			victim = pos;
+			break;
+		}
+		const uint64_t stamp = HAS_STAMP? *(const uint64_t*)RcExtra(block) : 0;
+		if (victim == SIZE_MAX || stamp < oldest) {
+			victim = pos;
+			oldest = stamp;
+		}
+	}
+	if (victim == SIZE_MAX) {
+		return false;
+	}
+	if (m_hooks.on_evict != nullptr) {
+		auto block = BLK(table[victim].blk);
+		m_hooks.on_evict({RcKey(block), Rc(block).klen});
+	}
+	_drop(victim);
+	RECORD_COUNT(EVICT, 1);
+	return true;
+}
+
+size_t Estuary::tombstone() const noexcept {
+	if (m_meta == nullptr) {
+		return 0;
+	}
+	return m_const.total_entry.value() - LoadRelaxed(m_meta->clean_entry) - LoadRelaxed(m_meta->item);
+}
+
+//move record at vic to block cursor or reclaim it if expired, separated to be recognizable in profiling
+NOINLINE void Estuary::_relocate(size_t vic) const {
+	auto& cur = m_meta->block_cursor;
+	assert(Rc(BLK(vic)).klen != 0);
+	const auto bcnt = RecordBlocks(BLK(vic), m_const.extra, m_const.block_bits);
+	if (UNLIKELY(_expired(BLK(vic)))) {	//reclaim instead of moving
+		SearchInTable([this, vic](Entry& ent, uint32_t tag)->bool{
+				const auto e = ent;
+				if (IsEmpty(e)) {
+					return IsClean(e);
+				} else if (e.blk == vic) {
+					UpdateEntry(GET_LOCK(tag), ent, DELETED_ENTRY);
+					ConsistencyAssert(m_meta->item != 0);
+					m_meta->item--;
+					return true;
+				}
+				return false;
+			}, HASH(RcKey(BLK(vic)), Rc(BLK(vic)).klen), (Entry*)m_table, m_const.total_entry);
+		Rc(BLK(vic)) = MarkForEmpty(bcnt);
+		m_meta->free_block += bcnt;
+		ConsistencyAssert(m_meta->free_block <= m_const.total_block);
+		return;
+	}
+	memcpy(BLK(cur)+sizeof(RecordMark), BLK(vic)+sizeof(RecordMark), (bcnt<<m_const.block_bits)-sizeof(RecordMark));
+	RECORD_COUNT(DATA_BYTE, bcnt << m_const.block_bits);
+	bool done = false;
+	SearchInTable([this, &cur, vic, bcnt, &done](Entry& ent, uint32_t tag)->bool{
+			const auto e = ent;
+			if (IsEmpty(e)) {
+				return IsClean(e);
+			} else if (e.blk == vic) {
+				m_meta->free_block -= bcnt;
+				auto next = cur + bcnt;
+				if (LIKELY(next != m_const.total_block)) {
+					ConsistencyAssert(next < m_const.total_block);
+					Rc(BLK(next)) = MarkForEmpty(Rc(BLK(cur)).bcnt-bcnt);
+				}
+				Rc(BLK(cur)) = Rc(BLK(vic));
+				UpdateEntry(GET_LOCK(tag), ent, Entry(cur,tag));
+				Rc(BLK(vic)) = MarkForEmpty(bcnt);
+				cur = next;
+				m_meta->free_block += bcnt;
+				done = true;
+				return true;
+			}
+			return false;
+		}, HASH(RcKey(BLK(vic)), Rc(BLK(vic)).klen), (Entry*)m_table, m_const.total_entry);
+	if (UNLIKELY(!done)) {
+		Rc(BLK(vic)) = MarkForEmpty(bcnt);
+		m_meta->free_block += bcnt;
+		ConsistencyAssert(m_meta->free_block <= m_const.total_block);
+	}
+}
+
+bool Estuary::_update(Slice key, uint64_t code, Slice val, const Deadline* deadline, uint64_t expiry) const {
+	auto timeout = [deadline]()->bool {
+		return deadline != nullptr && std::chrono::system_clock::now() >= *deadline;
+	};
+
+	if (expiry == 0) {
+		expiry = _default_expiry();
+	}
+
+	//same-size overwrite needs neither allocation nor tombstone, same value needs no write at all
+	if (_update_in_place(key, code, val, expiry)) {
+		return true;
+	}
+
+	auto new_block = RecordBlocks(key.len, val.len, m_const.extra, m_const.block_bits);
+	while (m_meta->free_block < new_block + TOTAL_RESERVED_BLOCK
+		|| TotalEntry(m_meta->item) > m_const.total_entry.value()) {
+		if (m_evict_samples == 0 || !_evict()) {
+			m_reject = m_meta->free_block < new_block + TOTAL_RESERVED_BLOCK? Error::NO_SPACE : Error::TABLE_FULL;
+			return false;
+		}
+	}
+	ConsistencyAssert(m_meta->block_cursor < m_const.total_block
+		&& m_meta->free_block <= m_const.total_block
+		&& m_meta->clean_entry <= m_const.total_entry.value());
+
+	if (UNLIKELY(m_meta->clean_entry <= m_const.total_entry.value() / m_const.entry_reserve
+		|| (m_tombstone_limit != 0 && tombstone() > m_ext->swept_dirty + m_tombstone_limit))) {
+		if (timeout()) {
+			m_reject = Error::TIMEOUT;
+			return false;
+		}
+		_sweep();
+		if (m_hooks.on_sweep != nullptr) {
+			m_hooks.on_sweep(m_ext->swept_dirty);
+		}
+	}
+
+	auto& cur = m_meta->block_cursor;
+	ConsistencyAssert(Rc(BLK(cur)).klen == 0 && cur+Rc(BLK(cur)).bcnt <= m_const.total_block);
+
+	//defragmentation
+	ConsistencyAssert(Rc(BLK(cur)).bcnt >= m_const.reserved_block);
+	bool overflow = false;
+	while (Rc(BLK(cur)).bcnt < new_block + m_const.reserved_block) {
+		if (timeout()) {	//it's safe to stop between steps
+			m_reject = Error::TIMEOUT;
+			return false;
+		}
+		auto nxt = cur + Rc(BLK(cur)).bcnt;
+		if (UNLIKELY(nxt == m_const.total_block)) {
+			ConsistencyAssert(!overflow && m_meta->free_block >= Rc(BLK(cur)).bcnt);
+			overflow = true; //no more than once
+			size_t vic = 0;
+			while (vic < cur) {	//some blocks may be moved more than once
+				if (Rc(BLK(vic)).klen == 0) {
+					vic += Rc(BLK(vic)).bcnt;
+				} else if (vic < new_block + m_const.reserved_block) {
+					const auto bcnt = RecordBlocks(BLK(vic), m_const.extra, m_const.block_bits);
+					if (Rc(BLK(cur)).bcnt < bcnt) {
+						break;
+					}
+					_relocate(vic);
+					vic += bcnt;
+					if (UNLIKELY(cur == m_const.total_block)) {
+						break;
+					}
+				} else {
+					break;
+				}
+			}
+			ConsistencyAssert(vic <= cur);
+			Rc(m_data) = MarkForEmpty(vic);
+			cur = 0;
+		} else {
+			size_t bcnt;
+			if (Rc(BLK(nxt)).klen == 0) {
+				ConsistencyAssert(nxt+Rc(BLK(nxt)).bcnt <= m_const.total_block);
+				bcnt = Rc(BLK(nxt)).bcnt;
+			} else { //reserved_block must be enough
+				bcnt = RecordBlocks(BLK(nxt), m_const.extra, m_const.block_bits);
+				ConsistencyAssert(bcnt <= Rc(BLK(cur)).bcnt);
+				_relocate(nxt);
+			}
+			Rc(BLK(cur)).bcnt += bcnt;
+		}
+	}
+
+	m_meta->free_block -= new_block;
+	const auto next = cur + new_block;
+	Rc(BLK(next)) = MarkForEmpty(Rc(BLK(cur)).bcnt-new_block);
+	Rc(BLK(cur)).bcnt = new_block;
+	const auto neo = cur;
+	cur = next;
+	FillRecord(BLK(neo), key, val);
+	_fill_extra(BLK(neo), expiry == KEEP_EXPIRY? _default_expiry() : expiry);
+	RECORD_COUNT(LOGICAL_BYTE, key.len + val.len);
+	RECORD_COUNT(DATA_BYTE, new_block << m_const.block_bits);
+
+	//the key may exist behind deleted entries, so the first vacancy can only be taken at end of chain
+	bool done = false;
+	Entry* vacancy = nullptr;
+	SearchInTable([this, neo, key, expiry, &done, &vacancy](Entry& ent, uint32_t tag)->bool{
+			const auto e = ent;
+			if (IsEmpty(e)) {
+				if (vacancy == nullptr) {
+					vacancy = &ent;
+					if (IsClean(e)) {
+						m_meta->clean_entry--;
+					}
+				}
+				return IsClean(e);
+			} else if (e.tag == tag) {
+				auto block = BLK(e.blk);
+				ConsistencyAssert(Rc(block).klen != 0 && Rc(block).vlen <= max_val_len());
+				if (LIKELY(KeyMatch(key, block))) {
+					const auto bcnt = RecordBlocks(block, m_const.extra, m_const.block_bits);
+					if (expiry == KEEP_EXPIRY && HAS_TTL) {
+						EXPIRY(BLK(neo)) = _inherit_expiry(block);
+					}
+					UpdateEntry(GET_LOCK(tag), ent, Entry(neo, tag));
+					Rc(block) = MarkForEmpty(bcnt);
+					m_meta->free_block += bcnt;
+					ConsistencyAssert(m_meta->free_block <= m_const.total_block);
+					done = true;
+					return true;
+				}
+			}
+			return false;
+		}, code, (Entry*)m_table, m_const.total_entry);
+	if (!done && vacancy != nullptr) {
+		vacancy->store_release(Entry(neo, code >> (64U - TAG_BITWIDTH)));
+		m_meta->item++;
+		done = true;
+	}
+	if (!done) {
+		m_reject = Error::TABLE_FULL;
+	}
+	return done;
+}
+
+bool Estuary::_intact(uint64_t blk, uint32_t tag) const {
+	if (blk >= m_const.total_block) {
+		return false;
+	}
+	auto block = BLK(blk);
+	if (Rc(block).klen == 0 || Rc(block).klen > max_key_len() || Rc(block).vlen > max_val_len()
+		|| blk + RecordBlocks(block, m_const.extra, m_const.block_bits) > m_const.total_block) {
+		return false;
+	}
+	const auto code = HASH(RcKey(block), Rc(block).klen);
+	return tag == (code >> (64U - TAG_BITWIDTH));
+}
+
+static bool IsPrintable(const uint8_t* str, size_t len) noexcept {
+	for (size_t i = 0; i < len; i++) {
+		if (!isprint(str[i])) {
+			return false;
+		}
+	}
+	return true;
+}
+
+void Estuary::_report_quarantine(size_t idx, uint64_t blk) const {
+	if (blk >= m_const.total_block) {
+		Logger::Printf("quarantine entry %lu with bad block %lu\n", idx, blk);
+		return;
+	}
+	auto block = BLK(blk);
+	const unsigned klen = Rc(block).klen;
+	if (klen == 0 || klen > max_key_len()
+		|| blk + RecordBlocks(klen, 0, 0, m_const.block_bits) > m_const.total_block) {
+		Logger::Printf("quarantine entry %lu with bad key length %u\n", idx, klen);
+		return;
+	}
+	const auto code = HASH(RcKey(block), klen);
+	if (IsPrintable(RcKey(block), klen)) {
+		Logger::Printf("quarantine entry %lu with key \"%.*s\" (hash %016lx)\n",
+			idx, (int)klen, (const char*)RcKey(block), code);
+	} else {
+		Logger::Printf("quarantine entry %lu with key of %u bytes (hash %016lx)\n", idx, klen, code);
+	}
+}
+
+size_t Estuary::quarantine() const {
+	if (m_meta == nullptr) {
+		return 0;
+	}
+	size_t cnt = 0;
+	{
+		MutexLock master_lock(&m_locks->master);
+		if (m_meta->writing) {
+			throw DataException();
+		}
+		if (m_sealed || m_ext->frozen) {
+			return 0;
+		}
+		_begin_write();
+		auto table = (Entry*)m_table;
+		for (size_t i = 0; i < m_const.total_entry.value(); i++) {
+			const auto e = table[i];
+			if (IsEmpty(e) || LIKELY(_intact(e.blk, e.tag))) {
+				continue;
+			}
+			_report_quarantine(i, e.blk);
+			UpdateEntry(GET_LOCK(e.tag), table[i], DELETED_ENTRY);
+			if (m_meta->item != 0) {
+				m_meta->item--;
+			}
+			cnt++;
+		}
+		m_ext->quarantined += cnt;
+		_end_write();
+	}
+	if (cnt != 0) {
+		_corrupted();	//out of master lock
+	}
+	return cnt;
+}
+
+void Estuary::on_corruption(CorruptionHandler handler, bool freeze) {
+	m_corruption.handler = std::move(handler);
+	m_corruption.freeze = freeze;
+}
+
+void Estuary::_corrupted() const {
+	if (m_corruption.freeze) {
+		freeze_writes();
+	}
+	if (m_corruption.handler) {
+		m_corruption.handler(*this);
+	}
+}
+
+bool Estuary::freeze_writes() const {
+	if (m_meta == nullptr) {
+		return false;
+	}
+	MutexLock master_lock(&m_locks->master);
+	if (m_meta->writing) {
+		throw DataException();
+	}
+	m_ext->frozen = true;
+	return true;
+}
+
+bool Estuary::thaw_writes() const {
+	if (m_meta == nullptr) {
+		return false;
+	}
+	MutexLock master_lock(&m_locks->master);
+	m_ext->frozen = false;
+	return true;
+}
+
+bool Estuary::seal(double load_factor) {
+	if (m_meta == nullptr || m_monopoly_extra == nullptr || !(load_factor >= 0 && load_factor < 1)) {
+		return false;
+	}
+	if (m_sealed) {
+		return true;
+	}
+	MutexLock master_lock(&m_locks->master);
+	if (m_meta->writing) {
+		throw DataException();
+	}
+	size_t total = 0;
+	if (load_factor != 0) {
+		total = std::min(std::max(m_meta->item / load_factor, (double)MIN_ENTRY), (double)MAX_ENTRY);
+	}
+	if (total > m_const.total_entry.value()) {
+		m_sparse.table = std::make_unique<uint64_t[]>(total);
+		m_sparse.total_entry = Divisor<uint64_t>(total);
+		auto table = (Entry*)m_sparse.table.get();
+		for (size_t i = 0; i < total; i++) {
+			table[i] = CLEAN_ENTRY;
+		}
+		for (size_t i = 0; i < m_const.total_entry.value(); i++) {
+			const auto e = *(const Entry*)(m_table+i);
+			if (IsEmpty(e)) {
+				continue;
+			}
+			auto block = BLK(e.blk);
+			SearchInTable([&e](Entry& ent, uint32_t tag)->bool{
+					if (!IsClean(ent)) {
+						return false;
+					}
+					ent = Entry(e.blk, tag);
+					return true;
+				}, HASH(RcKey(block), Rc(block).klen), table, m_sparse.total_entry);
+		}
+	}
+	if (!m_resource.protect((uint8_t*)m_table - m_resource.addr(), false)) {
+		m_sparse.table.reset();
+		return false;
+	}
+	m_sealed = true;
+	return true;
+}
+
+bool Estuary::unseal() {
+	if (m_meta == nullptr) {
+		return false;
+	}
+	if (!m_sealed) {
+		return true;
+	}
+	MutexLock master_lock(&m_locks->master);
+	if (!m_resource.protect((uint8_t*)m_table - m_resource.addr(), true)) {
+		return false;
+	}
+	m_sealed = false;
+	m_sparse.table.reset();
+	return true;
+}
+
+bool Estuary::writes_frozen() const noexcept {
+	return m_meta != nullptr && (m_sealed || LoadRelaxed(m_ext->frozen));
+}
+
+uint64_t Estuary::generation() const noexcept {
+	return m_meta == nullptr? 0 : LoadAcquire(m_ext->generation);
+}
+
+size_t Estuary::quarantined() const noexcept {
+	return m_meta == nullptr? 0 : m_ext->quarantined;
+}
+
+bool Estuary::self_test(unsigned sample) const {
+	if (m_meta == nullptr) {
+		return false;
+	}
+	bool intact = false;
+	{	//sweeping or relocation under way would look like damage
+		MutexLock master_lock(&m_locks->master);
+		if (m_meta->writing) {
+			throw DataException();
 		}
+		intact = _self_test(sample);
 	}
-	auto buf = block + 8;
-	if (key.len > 0) {
-		memcpy(buf, key.ptr, key.len);
-		buf += key.len;
+	if (!intact) {
+		_corrupted();	//out of master lock
+		return false;
 	}
-	if (val.len > 0) {
-		memcpy(buf, val.ptr, val.len);
+	return true;
+}
+
+bool Estuary::_self_test(unsigned sample) const {
+	auto table = (const Entry*)m_table;
+	const auto total = m_const.total_entry.value();
+	const bool full = sample >= total;
+	auto rnd = Clock::Seed();
+	for (size_t i = 0; i < sample && i < total; i++) {
+		rnd = rnd * 6364136223846793005ULL + 1442695040888963407ULL;
+		const size_t pos = full? i : rnd % total;
+		const auto e = table[pos];
+		if (IsEmpty(e)) {
+			continue;
+		}
+		if (!_intact(e.blk, e.tag)) {
+			Logger::Printf("self test: entry %lu points to broken record %lu\n", pos, (uint64_t)e.blk);
+			return false;
+		}
+		auto block = BLK(e.blk);
+		const auto code = HASH(RcKey(block), Rc(block).klen);
+		size_t home = code % m_const.total_entry;
+		for (; home != pos; home = (home+1 < total)? home+1 : 0) {
+			if (IsClean(table[home])) {
+				Logger::Printf("self test: entry %lu is unreachable from bucket %lu\n", pos, home);
+				return false;
+			}
+		}
 	}
-	Rc(block) = mark;
+	return true;
 }
 
-bool Estuary::update(Slice key, Slice val) const {
-	if (m_meta == nullptr
-		|| key.ptr == nullptr || key.len == 0 || key.len > max_key_len()
-		|| (val.len != 0 && val.ptr == nullptr) || val.len > max_val_len()) {
-		return false;
+void Estuary::for_each_stable(const Visitor& visitor, uint64_t seed) const {
+	if (m_meta == nullptr) {
+		return;
 	}
 	MutexLock master_lock(&m_locks->master);
-	if (m_meta->writing) {
-		throw DataException();
+	struct Item {
+		uint64_t code;
+		uint64_t blk;
+	};
+	std::vector<Item> items;
+	items.reserve(m_meta->item);
+	auto table = (const Entry*)m_table;
+	for (size_t i = 0; i < m_const.total_entry.value(); i++) {
+		const auto e = table[i];
+		if (!IsEmpty(e) && !_expired(BLK(e.blk))) {
+			auto block = BLK(e.blk);
+			items.push_back({Hash(RcKey(block), Rc(block).klen, seed), e.blk});
+		}
+	}
+	std::sort(items.begin(), items.end(), [this](const Item& a, const Item& b)->bool {
+		if (a.code != b.code) {
+			return a.code < b.code;
+		}
+		auto x = BLK(a.blk);
+		auto y = BLK(b.blk);
+		auto ret = memcmp(RcKey(x), RcKey(y), std::min(Rc(x).klen, Rc(y).klen));
+		return ret < 0 || (ret == 0 && Rc(x).klen < Rc(y).klen);
+	});
+	for (auto& item : items) {
+		auto block = BLK(item.blk);
+		visitor({RcKey(block), Rc(block).klen}, {RcVal(block), Rc(block).vlen});
 	}
-	m_meta->writing = true;
-	auto done = _update(key, val);
-	m_meta->writing = false;
-	return done;
 }
 
-#define TOTAL_RESERVED_BLOCK (m_const.reserved_block + (m_const.total_block-m_const.reserved_block)/DATA_RESERVE_FACTOR)
-
-size_t Estuary::data_free() const {
-	if (m_meta == nullptr) return 0;
-	ConsistencyAssert(m_meta->free_block >= TOTAL_RESERVED_BLOCK);
-	return (m_meta->free_block - TOTAL_RESERVED_BLOCK) * DATA_BLOCK_SIZE;
-}
-size_t Estuary::item_limit() const {
-	if (m_meta == nullptr) return 0;
-	return ItemLimit(m_const.total_entry.value());
+uint64_t Estuary::scan(uint64_t cursor, size_t limit, std::vector<Item>& out) const {
+	out.clear();
+	if (m_meta == nullptr || limit == 0 || cursor >= m_const.total_entry.value()) {
+		return 0;
+	}
+	MutexLock master_lock(&m_locks->master);
+	auto table = (const Entry*)m_table;
+	for (; cursor < m_const.total_entry.value() && out.size() < limit; cursor++) {
+		const auto e = table[cursor];
+		if (!IsEmpty(e) && !_expired(BLK(e.blk))) {
+			auto block = BLK(e.blk);
+			out.push_back({std::string((const char*)RcKey(block), Rc(block).klen),
+						   std::string((const char*)RcVal(block), Rc(block).vlen)});
+		}
+	}
+	return cursor < m_const.total_entry.value()? cursor : 0;
 }
 
-bool Estuary::_update(Slice key, Slice val) const {
-	auto new_block = RecordBlocks(key.len, val.len);
-	if (m_meta->free_block < new_block + TOTAL_RESERVED_BLOCK
-		|| TotalEntry(m_meta->item) > m_const.total_entry.value()) {
-		return false;
+void Estuary::keys(Slice pattern, size_t limit, std::vector<std::string>& out) const {
+	out.clear();
+	if (m_meta == nullptr || limit == 0 || (pattern.len != 0 && pattern.ptr == nullptr)) {
+		return;
 	}
-	ConsistencyAssert(m_meta->block_cursor < m_const.total_block
-		&& m_meta->free_block <= m_const.total_block
-		&& m_meta->clean_entry <= m_const.total_entry.value());
-
-	if (UNLIKELY(m_meta->clean_entry <= m_const.total_entry.value() / ENTRY_RESERVE_FACTOR)) {
-		//x times random input brings 1-1/e^x coverage，x = ln(ENTRY_RESERVE_FACTOR)
-		//this procedure is slow, but rarely happen
-		//TODO: need better algorithm
-
-		auto get_hash_code = [this](Entry entry)->uint64_t {
-			auto block = BLK(entry.blk);
-			const auto code = Hash(RcKey(block), Rc(block).klen, m_const.seed);
-			ConsistencyAssert(entry.tag == (code>>(64U - TAG_BITWIDTH)));
-			return code;
-		};
-
-		auto table = (Entry*)m_table;
-		auto& total_entry = m_const.total_entry;
-		auto upstairs = [table, &total_entry, &get_hash_code](bool end)->bool {
-			bool moved = false;
-			for (size_t i = 0; i < total_entry.value(); i++) {
-				if (LIKELY(IsEmpty(table[i]) || table[i].fit)) {
-					continue;
+	constexpr size_t STEP = 4096;
+	auto table = (const Entry*)m_table;
+	for (size_t i = 0; i < m_const.total_entry.value() && out.size() < limit; ) {
+		MutexLock master_lock(&m_locks->master);
+		const auto end = std::min(i + STEP, m_const.total_entry.value());
+		for (; i < end && out.size() < limit; i++) {
+			const auto e = table[i];
+			if (!IsEmpty(e) && !_expired(BLK(e.blk))) {
+				auto block = BLK(e.blk);
+				Slice key = {RcKey(block), Rc(block).klen};
+				if (GlobMatch(pattern, key)) {
+					out.emplace_back((const char*)key.ptr, key.len);
 				}
-				bool fit = true;
-				auto curr = &table[i];
-				SearchInTable([&fit, &moved, curr, end](Entry& ent, uint32_t tag)->bool{
-					if (IsEmpty(ent)) {
-						moved = true;
-						ConsistencyAssert(!IsClean(ent));
-						ent = *curr;
-						if (fit) {
-							ent.fit = 1;
-						}
-						curr->store_release(DELETED_ENTRY);
-						if (end) {
-							curr->fit = 1;
-						}
-						return true;
-					} else if (!ent.fit) {
-						if (&ent == curr) {
-							curr->fit = 1;
-							return true;
-						}
-						fit = false;
-					}
-					return false;
-				}, get_hash_code(*curr), table, total_entry);
 			}
-			return moved;
-		};
-
-		//entry can be moved twice at most
-		m_meta->sweeping = true;
-		MemoryBarrier();
-		if (upstairs(false)) {
-			upstairs(true);
 		}
+	}
+}
 
-		size_t dirty = 0;
-		size_t item = 0;
-		for (size_t i = 0; i < total_entry.value(); i++) {
-			if (IsEmpty(table[i])) {
-				if (table[i].fit) {
-					dirty++;
-					table[i].fit = 0;
-				} else {
-					table[i] = CLEAN_ENTRY;
+size_t Estuary::count(const std::function<bool(Slice key)>& pred) const {
+	if (m_meta == nullptr) {
+		return 0;
+	}
+	constexpr size_t STEP = 4096;
+	auto table = (const Entry*)m_table;
+	size_t cnt = 0;
+	for (size_t i = 0; i < m_const.total_entry.value(); ) {
+		MutexLock master_lock(&m_locks->master);
+		const auto end = std::min(i + STEP, m_const.total_entry.value());
+		for (; i < end; i++) {
+			const auto e = table[i];
+			if (!IsEmpty(e) && !_expired(BLK(e.blk))) {
+				auto block = BLK(e.blk);
+				if (pred({RcKey(block), Rc(block).klen})) {
+					cnt++;
 				}
-			} else {
-				item++;
-				table[i].fit = 0;
 			}
 		}
+	}
+	return cnt;
+}
 
-		//keep sweeping status longer
-		MemoryBarrier();
-		m_meta->sweeping = false;
+static constexpr uint64_t EXPORT_MAGIC = 0x74726F7078457345ULL;	//"EsExport"
 
-		ConsistencyAssert(item = m_meta->item);
-		m_meta->clean_entry = total_entry.value() - item - dirty;
-	}
+struct ExportHeader {
+	uint64_t magic = 0;
+	uint64_t item = 0;
+	uint64_t size = 0;	//bytes of records behind header
+};
 
-	auto& cur = m_meta->block_cursor;
-	ConsistencyAssert(Rc(BLK(cur)).klen == 0 && cur+Rc(BLK(cur)).bcnt <= m_const.total_block);
+//record: klen(4B) + vlen(4B) + key + val
+class ExportReader final : public IDataReader {
+public:
+	ExportReader(const uint8_t* data, size_t item) noexcept
+		: m_data(data), m_pos(data), m_item(item) {}
+	void reset() override { m_pos = m_data; }
+	size_t total() override { return m_item; }
+	Record read() override {
+		uint32_t len[2];
+		memcpy(len, m_pos, sizeof(len));
+		Record out;
+		out.key = {m_pos + sizeof(len), len[0]};
+		out.val = {out.key.ptr + len[0], len[1]};
+		m_pos = out.val.ptr + len[1];
+		return out;
+	}
 
-	auto move_record = [this, &cur](size_t vic) {
-		assert(Rc(BLK(vic)).klen != 0);
-		const auto bcnt = RecordBlocks(BLK(vic));
-		memcpy(BLK(cur)+sizeof(RecordMark), BLK(vic)+sizeof(RecordMark), bcnt*DATA_BLOCK_SIZE-sizeof(RecordMark));
-		bool done = false;
-		SearchInTable([this, &cur, vic, bcnt, &done](Entry& ent, uint32_t tag)->bool{
-				const auto e = ent;
-				if (IsEmpty(e)) {
-					return IsClean(e);
-				} else if (e.blk == vic) {
-					m_meta->free_block -= bcnt;
-					auto next = cur + bcnt;
-					if (LIKELY(next != m_const.total_block)) {
-						ConsistencyAssert(next < m_const.total_block);
-						Rc(BLK(next)) = MarkForEmpty(Rc(BLK(cur)).bcnt-bcnt);
-					}
-					Rc(BLK(cur)) = Rc(BLK(vic));
-					UpdateEntry(GET_LOCK(tag), ent, Entry(cur,tag));
-					Rc(BLK(vic)) = MarkForEmpty(bcnt);
-					cur = next;
-					m_meta->free_block += bcnt;
-					done = true;
-					return true;
-				}
+	//every record should be inside the range
+	static bool Check(const uint8_t* data, size_t size, size_t item) noexcept {
+		const auto end = data + size;
+		for (size_t i = 0; i < item; i++) {
+			uint32_t len[2];
+			if ((size_t)(end - data) < sizeof(len)) {
 				return false;
-			}, Hash(RcKey(BLK(vic)), Rc(BLK(vic)).klen, m_const.seed), (Entry*)m_table, m_const.total_entry);
-		if (UNLIKELY(!done)) {
-			Rc(BLK(vic)) = MarkForEmpty(bcnt);
-			m_meta->free_block += bcnt;
-			ConsistencyAssert(m_meta->free_block <= m_const.total_block);
-		}
-	};
-
-	//defragmentation
-	ConsistencyAssert(Rc(BLK(cur)).bcnt >= m_const.reserved_block);
-	bool overflow = false;
-	while (Rc(BLK(cur)).bcnt < new_block + m_const.reserved_block) {
-		auto nxt = cur + Rc(BLK(cur)).bcnt;
-		if (UNLIKELY(nxt == m_const.total_block)) {
-			ConsistencyAssert(!overflow && m_meta->free_block >= Rc(BLK(cur)).bcnt);
-			overflow = true; //no more than once
-			size_t vic = 0;
-			while (vic < cur) {	//some blocks may be moved more than once
-				if (Rc(BLK(vic)).klen == 0) {
-					vic += Rc(BLK(vic)).bcnt;
-				} else if (vic < new_block + m_const.reserved_block) {
-					const auto bcnt = RecordBlocks(BLK(vic));
-					if (Rc(BLK(cur)).bcnt < bcnt) {
-						break;
-					}
-					move_record(vic);
-					vic += bcnt;
-					if (UNLIKELY(cur == m_const.total_block)) {
-						break;
-					}
-				} else {
-					break;
-				}
 			}
-			ConsistencyAssert(vic <= cur);
-			Rc(m_data) = MarkForEmpty(vic);
-			cur = 0;
-		} else {
-			size_t bcnt;
-			if (Rc(BLK(nxt)).klen == 0) {
-				ConsistencyAssert(nxt+Rc(BLK(nxt)).bcnt <= m_const.total_block);
-				bcnt = Rc(BLK(nxt)).bcnt;
-			} else { //reserved_block must be enough
-				bcnt = RecordBlocks(BLK(nxt));
-				ConsistencyAssert(bcnt <= Rc(BLK(cur)).bcnt);
-				move_record(nxt);
+			memcpy(len, data, sizeof(len));
+			data += sizeof(len);
+			if ((size_t)(end - data) < (uint64_t)len[0] + len[1]) {
+				return false;
 			}
-			Rc(BLK(cur)).bcnt += bcnt;
+			data += len[0] + len[1];
 		}
+		return data == end;
 	}
 
-	m_meta->free_block -= new_block;
-	const auto next = cur + new_block;
-	Rc(BLK(next)) = MarkForEmpty(Rc(BLK(cur)).bcnt-new_block);
-	Rc(BLK(cur)).bcnt = new_block;
-	const auto neo = cur;
-	cur = next;
-	FillRecord(BLK(neo), key, val);
+private:
+	const uint8_t* m_data;
+	const uint8_t* m_pos;
+	size_t m_item;
+};
 
-	bool done = false;
-	SearchInTable([this, &cur, neo, key, val, &done](Entry& ent, uint32_t tag)->bool{
-			const auto e = ent;
-			if (IsEmpty(e)) {
-				if (IsClean(e)) {
-					m_meta->clean_entry--;
+static bool WriteAll(int fd, const std::string& data) noexcept {
+	for (size_t off = 0; off < data.size(); ) {
+		auto sz = write(fd, data.data()+off, data.size()-off);
+		if (sz <= 0) {
+			return false;
+		}
+		off += sz;
+	}
+	return true;
+}
+
+bool Estuary::export_prefix(Slice prefix, const std::string& path, size_t* cnt) const {
+	if (m_meta == nullptr || (prefix.len != 0 && prefix.ptr == nullptr)) {
+		return false;
+	}
+	auto fd = open(path.c_str(), O_CREAT|O_TRUNC|O_WRONLY, 0644);
+	if (fd < 0) {
+		Logger::Printf("fail to open file: %s\n", path.c_str());
+		return false;
+	}
+	//header is filled at last, so that unfinished file will not be accepted
+	ExportHeader header;
+	bool done = write(fd, &header, sizeof(header)) == sizeof(header);
+	header.magic = EXPORT_MAGIC;
+
+	constexpr size_t STEP = 4096;
+	constexpr size_t KEPT_BUFFER = 1U << 20U;
+	auto table = (const Entry*)m_table;
+	thread_local std::string buf;	//reused by calls in the same thread unless it grows too big
+	for (size_t i = 0; done && i < m_const.total_entry.value(); ) {
+		buf.clear();
+		{
+			MutexLock master_lock(&m_locks->master);
+			const auto end = std::min(i + STEP, m_const.total_entry.value());
+			for (; i < end; i++) {
+				const auto e = table[i];
+				if (IsEmpty(e) || _expired(BLK(e.blk))) {
+					continue;
 				}
-				ent.store_release(Entry(neo, tag));
-				m_meta->item++;
-				done = true;
-				return true;
-			} else if (e.tag == tag) {
 				auto block = BLK(e.blk);
-				ConsistencyAssert(Rc(block).klen != 0 && Rc(block).vlen <= max_val_len());
-				if (LIKELY(KeyMatch(key, block))) {
-					const auto bcnt = RecordBlocks(block);
-					if (UNLIKELY(ValMatch(val, block))) {	//rollback
-						Rc(BLK(neo)) = MarkForEmpty(bcnt);
-						const auto tail = Rc(BLK(cur)).bcnt;
-						cur = neo;
-						Rc(BLK(neo)) = MarkForEmpty(bcnt+tail);
-					} else {
-						UpdateEntry(GET_LOCK(tag), ent, Entry(neo, tag));
-						Rc(block) = MarkForEmpty(bcnt);
-					}
-					m_meta->free_block += bcnt;
-					ConsistencyAssert(m_meta->free_block <= m_const.total_block);
-					done = true;
-					return true;
+				const uint32_t len[2] = {Rc(block).klen, Rc(block).vlen};
+				if (prefix.len != 0 && (len[0] < prefix.len || memcmp(RcKey(block), prefix.ptr, prefix.len) != 0)) {
+					continue;
 				}
+				buf.append((const char*)len, sizeof(len));
+				buf.append((const char*)RcKey(block), len[0]);
+				buf.append((const char*)RcVal(block), len[1]);
+				header.item++;
 			}
-			return false;
-		}, Hash(key.ptr, key.len, m_const.seed), (Entry*)m_table, m_const.total_entry);
-	return done;
+		}
+		//out of master lock
+		done = WriteAll(fd, buf);
+		header.size += buf.size();
+	}
+	if (buf.capacity() > KEPT_BUFFER) {
+		std::string().swap(buf);
+	}
+	done = done && pwrite(fd, &header, sizeof(header), 0) == sizeof(header);
+	close(fd);
+	if (!done) {
+		Logger::Printf("fail to write file: %s\n", path.c_str());
+		return false;
+	}
+	if (cnt != nullptr) {
+		*cnt = header.item;
+	}
+	return true;
+}
+
+size_t Estuary::import_from(const std::string& path, const IngestOptions& options) const {
+	if (m_meta == nullptr) {
+		return 0;
+	}
+	MemMap file(path.c_str());
+	if (!file) {
+		return 0;
+	}
+	ExportHeader header;
+	if (file.size() < sizeof(header)) {
+		Logger::Printf("broken export file: %s\n", path.c_str());
+		return 0;
+	}
+	memcpy(&header, file.addr(), sizeof(header));
+	const auto data = file.addr() + sizeof(header);
+	if (header.magic != EXPORT_MAGIC || header.size != file.size() - sizeof(header)
+		|| !ExportReader::Check(data, header.size, header.item)) {
+		Logger::Printf("broken export file: %s\n", path.c_str());
+		return 0;
+	}
+	ExportReader source(data, header.item);
+	return _ingest(source, options, true);	//exported keys are transformed already
 }
 
 static bool InitLocks(Estuary::Locks* locks, uint16_t mask, bool shared=true) {
@@ -617,6 +2412,8 @@ static bool InitLocks(Estuary::Locks* locks, uint16_t mask, bool shared=true) {
 }
 
 Estuary::~Estuary() noexcept {
+	delete m_stats;
+	delete m_latency;
 	if (m_meta == nullptr) {
 		return;
 	}
@@ -632,11 +2429,14 @@ static FORCE_INLINE size_t LocksSize(uint16_t mask) {
 	return sizeof(Estuary::Locks) + (mask+1U) * sizeof(SharedMutex);
 }
 
+static constexpr unsigned MAX_CONCURRENCY = 512;
+static constexpr size_t MAX_METADATA_SIZE = 1U << 20U;
+
 static FORCE_INLINE uint16_t CalcLockMask(unsigned concurrency) {
 	if (concurrency < 1) {
 		concurrency = 1;
-	} else if (concurrency > 512) {
-		concurrency = 512;
+	} else if (concurrency > MAX_CONCURRENCY) {
+		concurrency = MAX_CONCURRENCY;
 	}
 	auto n = 1U << (32U-__builtin_clz(concurrency-1));
 	assert(n > 0);
@@ -644,7 +2444,57 @@ static FORCE_INLINE uint16_t CalcLockMask(unsigned concurrency) {
 	return n*(256U/sizeof(SharedMutex))-1;
 }
 
-Estuary Estuary::Load(const std::string& path, LoadPolicy policy, unsigned concurrency) {
+static constexpr size_t MIN_ITEM_LIMIT = (MIN_ENTRY*2+2)/3;
+static constexpr size_t MAX_ITEM_LIMIT = (MAX_ENTRY*2+1)/3;
+static_assert(TotalEntry(MIN_ITEM_LIMIT) >= MIN_ENTRY && TotalEntry(MIN_ITEM_LIMIT-1) < MIN_ENTRY);
+static_assert(TotalEntry(MAX_ITEM_LIMIT) <= MAX_ENTRY && TotalEntry(MAX_ITEM_LIMIT+1) > MAX_ENTRY);
+
+std::string Estuary::metadata() const {
+	if (m_meta == nullptr) {
+		return {};
+	}
+	return std::string((const char*)BLK(m_const.total_block), m_ext->metadata_size);
+}
+
+bool Estuary::ReadMetadata(const std::string& path, std::string& out) {
+	auto fd = open(path.c_str(), O_RDONLY);
+	if (fd < 0) {
+		return false;
+	}
+	Header header;
+	bool done = false;
+	if (pread(fd, &header, sizeof(Meta), 0) == sizeof(Meta) && header.magic == MAGIC_V1) {
+		out.clear();
+		done = true;
+	} else if (pread(fd, &header, sizeof(header), 0) == sizeof(header) && header.magic == MAGIC
+		&& (header.lock_mask & (header.lock_mask+1U)) == 0 && header.metadata_size <= MAX_METADATA_SIZE
+		&& header.block_shift <= MAX_BLOCK_SHIFT) {
+		const auto off = sizeof(Header) + LocksSize(header.lock_mask)
+			+ header.total_entry * sizeof(Entry) + (header.total_block << (DATA_BLOCK_BITS + header.block_shift));
+		out.resize(header.metadata_size);
+		done = pread(fd, out.data(), out.size(), off) == (ssize_t)out.size();
+	}
+	close(fd);
+	return done;
+}
+
+Estuary::Limits Estuary::GetLimits() noexcept {
+	Limits out;
+	out.format = MAGIC;
+	out.min_item_limit = MIN_ITEM_LIMIT;
+	out.max_item_limit = MAX_ITEM_LIMIT;
+	out.max_key_len = MAX_KEY_LEN;
+	out.max_val_len = MAX_VAL_LEN;
+	out.max_concurrency = MAX_CONCURRENCY;
+	out.block_size = DATA_BLOCK_SIZE;
+	out.max_block_size = DATA_BLOCK_SIZE << MAX_BLOCK_SHIFT;
+	out.max_data_size = DATA_BLOCK_LIMIT * DATA_BLOCK_SIZE;
+	out.max_metadata_size = MAX_METADATA_SIZE;
+	return out;
+}
+
+NOINLINE Estuary Estuary::Load(const std::string& path, LoadPolicy policy, unsigned concurrency, unsigned self_test,
+					  const Progress& progress) {
 	Estuary out;
 	MemMap res;
 	switch (policy) {
@@ -655,22 +2505,36 @@ Estuary Estuary::Load(const std::string& path, LoadPolicy policy, unsigned concu
 			res = MemMap(path.c_str(), true, true);
 			break;
 		case COPY_DATA:
-			res = MemMap(path.c_str(), MemMap::load_by_copy);
+			res = MemMap(path.c_str(), MemMap::load_by_copy, progress);
 			break;
 		default:
 			return out;
 	}
-	if (!res || res.size() < sizeof(Header)) {
+	if (!res || res.size() < sizeof(Meta)) {
 		return out;
 	}
-	auto meta = (Header*)res.addr();
-	auto locks_off = sizeof(Header);
+	auto meta = (Meta*)res.addr();
+	std::unique_ptr<uint8_t[]> legacy_ext;
+	MetaExt* ext = nullptr;
+	if (meta->magic == MAGIC_V1) {
+		legacy_ext = std::make_unique<uint8_t[]>(sizeof(MetaExt));
+		ext = new(legacy_ext.get())MetaExt();
+	} else if (res.size() >= sizeof(Header)) {
+		ext = (Header*)res.addr();
+	}
+	auto locks_off = HeaderSize(meta->magic);
 	auto table_off = locks_off + LocksSize(meta->lock_mask);
 	auto data_off = table_off + meta->total_entry * sizeof(Entry);
-	if (meta->magic != MAGIC || (meta->lock_mask & (meta->lock_mask+1U)) != 0
+	if (ext == nullptr || (meta->magic != MAGIC && meta->magic != MAGIC_V1)
+		|| (meta->lock_mask & (meta->lock_mask+1U)) != 0
+		|| (ext->flags & ~(FLAG_RECORD_STAMP|FLAG_RECORD_TTL|FLAG_WYHASH)) != 0
 		|| meta->total_entry < MIN_ENTRY || meta->total_entry > MAX_ENTRY
 		|| meta->total_block < meta->total_entry || meta->total_block > DATA_BLOCK_LIMIT
-		|| res.size() < data_off + meta->total_block * DATA_BLOCK_SIZE) {
+		|| ext->block_shift > MAX_BLOCK_SHIFT
+		|| (ext->data_reserve != 0 && ext->data_reserve < MIN_DATA_RESERVE_FACTOR)
+		|| (ext->entry_reserve != 0 && ext->entry_reserve < MIN_ENTRY_RESERVE_FACTOR)
+		|| res.size() < data_off + (meta->total_block << (DATA_BLOCK_BITS + ext->block_shift))
+			+ ext->metadata_size) {
 		Logger::Printf("broken file: %s\n", path.c_str());
 		return out;
 	}
@@ -700,6 +2564,7 @@ Estuary Estuary::Load(const std::string& path, LoadPolicy policy, unsigned concu
 	}
 
 	out.m_meta = meta;
+	out.m_ext = ext;
 	out.m_locks = locks;
 	out.m_table = (uint64_t*)(res.addr()+table_off);
 	out.m_data = res.addr()+data_off;
@@ -707,7 +2572,13 @@ Estuary Estuary::Load(const std::string& path, LoadPolicy policy, unsigned concu
 	auto& mark = *(RecordMark*)&meta->kv_limit;
 	out.m_const.max_key_len = mark.klen;
 	out.m_const.max_val_len = mark.vlen;
-	out.m_const.reserved_block = RecordBlocks(mark.klen, mark.vlen) * 2;
+	out.m_const.block_bits = DATA_BLOCK_BITS + ext->block_shift;
+	out.m_const.data_reserve = ext->data_reserve != 0? ext->data_reserve : DATA_RESERVE_FACTOR;
+	out.m_const.entry_reserve = ext->entry_reserve != 0? ext->entry_reserve : ENTRY_RESERVE_FACTOR;
+	out.m_const.flags = ext->flags;
+	out.m_const.extra = ((ext->flags & FLAG_RECORD_STAMP)? sizeof(uint64_t) : 0)
+		+ ((ext->flags & FLAG_RECORD_TTL)? sizeof(uint64_t) : 0);
+	out.m_const.reserved_block = RecordBlocks(mark.klen, mark.vlen, out.m_const.extra, out.m_const.block_bits) * 2;
 	out.m_const.seed = meta->seed;
 	out.m_const.total_entry = meta->total_entry;
 	out.m_const.total_block = meta->total_block;
@@ -715,19 +2586,24 @@ Estuary Estuary::Load(const std::string& path, LoadPolicy policy, unsigned concu
 		return out;
 	}
 	out.m_monopoly_extra = std::move(monopoly_extra);
+	out.m_legacy_ext = std::move(legacy_ext);
 	out.m_resource = std::move(res);
+	if (self_test != 0 && !out.self_test(self_test)) {
+		Logger::Printf("fail to pass self test: %s\n", path.c_str());
+		return Estuary();
+	}
 	return out;
 }
 
 bool Estuary::ResetLocks(const std::string& path) {
 	Estuary out;
 	MemMap res(path.c_str(), false, true);
-	if (!res || res.size() < sizeof(Header)) {
+	if (!res || res.size() < sizeof(Meta)) {
 		return false;
 	}
-	auto meta = (Header*)res.addr();
-	auto locks_off = sizeof(Header);
-	if (meta->magic != MAGIC || (meta->lock_mask & (meta->lock_mask+1U)) != 0
+	auto meta = (Meta*)res.addr();
+	auto locks_off = HeaderSize(meta->magic);
+	if ((meta->magic != MAGIC && meta->magic != MAGIC_V1) || (meta->lock_mask & (meta->lock_mask+1U)) != 0
 		|| res.size() < locks_off + LocksSize(meta->lock_mask)) {
 		Logger::Printf("broken file: %s\n", path.c_str());
 		return false;
@@ -748,29 +2624,113 @@ bool Estuary::ResetLocks(const std::string& path) {
 	return true;
 }
 
-bool Estuary::Create(const std::string& path, const Config& config, IDataReader* source) {
-	if (TotalEntry(config.item_limit) < MIN_ENTRY || TotalEntry(config.item_limit) > MAX_ENTRY
+bool Estuary::rebuild(const std::string& path) const {
+	if (m_meta == nullptr) {
+		return false;
+	}
+	MutexLock master_lock(&m_locks->master);
+	if (m_meta->writing) {
+		throw DataException();
+	}
+	if (!m_resource.dump(path.c_str())) {
+		return false;
+	}
+	MemMap res(path.c_str(), false, true);
+	if (!res || res.size() != m_resource.size()) {
+		return false;
+	}
+	auto meta = (Meta*)res.addr();
+	auto locks = (Locks*)(res.addr() + HeaderSize(meta->magic));
+	auto table = (Entry*)(res.addr() + ((const uint8_t*)m_table - m_resource.addr()));
+	meta->reference = 0;
+	if (!InitLocks(locks, meta->lock_mask)) {
+		Logger::Printf("fail to reset locks in: %s\n", path.c_str());
+		return false;
+	}
+	uint32_t seed = Clock::Seed();
+	if (seed == m_const.seed) {
+		seed = ~seed;
+	}
+	meta->seed = seed;
+
+	for (size_t i = 0; i < m_const.total_entry.value(); i++) {
+		table[i] = CLEAN_ENTRY;
+	}
+	for (size_t i = 0; i < m_const.total_entry.value(); i++) {
+		const auto e = *(const Entry*)(m_table+i);
+		if (IsEmpty(e)) {
+			continue;
+		}
+		auto block = BLK(e.blk);
+		const auto code = (m_const.flags & FLAG_WYHASH)? WyHash(RcKey(block), Rc(block).klen, seed)
+			: Hash(RcKey(block), Rc(block).klen, seed);
+		SearchInTable([&e](Entry& ent, uint32_t tag)->bool{
+				if (!IsClean(ent)) {
+					return false;
+				}
+				ent = Entry(e.blk, tag);
+				return true;
+			}, code, table, m_const.total_entry);
+	}
+	meta->clean_entry = meta->total_entry - meta->item;
+	if (meta->magic != MAGIC_V1) {
+		auto ext = (Header*)res.addr();
+		ext->swept_dirty = 0;
+		ext->expire_cursor = 0;
+	}
+	return true;
+}
+
+bool Estuary::Create(const std::string& path, const Config& config, IDataReader* source, BuildReport* report) {
+	unsigned block_shift = 0;
+	while (block_shift < MAX_BLOCK_SHIFT && (DATA_BLOCK_SIZE << block_shift) < config.block_size) {
+		block_shift++;
+	}
+	if ((DATA_BLOCK_SIZE << block_shift) != config.block_size
+		|| TotalEntry(config.item_limit) < MIN_ENTRY || TotalEntry(config.item_limit) > MAX_ENTRY
 		|| config.max_key_len == 0 || config.max_key_len > MAX_KEY_LEN
-		|| config.max_val_len == 0 || config.max_val_len > MAX_VAL_LEN
-		|| config.avg_size_per_item < 2 || config.avg_size_per_item > config.max_key_len+config.max_val_len) {
+		|| config.max_val_len > MAX_VAL_LEN
+		|| config.avg_size_per_item == 0 || config.avg_size_per_item > config.max_key_len+config.max_val_len
+		|| config.data_reserve_factor < MIN_DATA_RESERVE_FACTOR || config.data_reserve_factor > MAX_RESERVE_FACTOR
+		|| config.entry_reserve_factor < MIN_ENTRY_RESERVE_FACTOR || config.entry_reserve_factor > MAX_RESERVE_FACTOR
+		|| config.metadata.size() > MAX_METADATA_SIZE || config.default_ttl.count() < 0) {
 		Logger::Printf("bad arguments\n");
 		return false;
 	}
+	const bool record_ttl = config.record_ttl || config.default_ttl.count() != 0;
 	Header header;
 	((RecordMark*)&header.kv_limit)->klen = config.max_key_len;
 	((RecordMark*)&header.kv_limit)->vlen = config.max_val_len;
-	header.seed = GetSeed();
+	header.seed = Clock::Seed();
+	header.block_shift = block_shift;
+	header.data_reserve = config.data_reserve_factor;
+	header.entry_reserve = config.entry_reserve_factor;
+	const unsigned bits = DATA_BLOCK_BITS + block_shift;
+	if (config.record_stamp) {
+		header.flags |= FLAG_RECORD_STAMP;
+	}
+	if (record_ttl) {
+		header.flags |= FLAG_RECORD_TTL;
+	}
+	if (config.hash_func == Config::WYHASH) {
+		header.flags |= FLAG_WYHASH;
+	}
+	auto hash = [&header](const uint8_t* msg, uint8_t len)->uint64_t {
+		return (header.flags & FLAG_WYHASH)? WyHash(msg, len, header.seed) : Hash(msg, len, header.seed);
+	};
+	header.default_ttl = config.default_ttl.count();
+	const size_t extra = (config.record_stamp? sizeof(uint64_t) : 0) + (record_ttl? sizeof(uint64_t) : 0);
 
 	static_assert(sizeof(Header)%sizeof(uintptr_t) == 0, "alignment check");
 
 	header.total_entry = TotalEntry(config.item_limit);
 	header.clean_entry = header.total_entry;
 	header.lock_mask = CalcLockMask(config.concurrency);
-	auto block_per_item = ((config.avg_size_per_item+sizeof(uint32_t))+(DATA_BLOCK_SIZE-1))/DATA_BLOCK_SIZE;
+	auto block_per_item = ((config.avg_size_per_item+sizeof(uint32_t)+extra)+((1U<<bits)-1U)) >> bits;
 	header.total_block = block_per_item * (config.item_limit + 1);
 	const auto init_end = header.total_block;
-	header.total_block += header.total_block / (DATA_RESERVE_FACTOR-1) + 1;
-	header.total_block += RecordBlocks(config.max_key_len, config.max_val_len) * 2;
+	header.total_block += header.total_block / (config.data_reserve_factor-1) + 1;
+	header.total_block += RecordBlocks(config.max_key_len, config.max_val_len, extra, bits) * 2;
 	if (header.total_block > DATA_BLOCK_LIMIT) {
 		Logger::Printf("too big\n");
 		return false;
@@ -783,7 +2743,9 @@ bool Estuary::Create(const std::string& path, const Config& config, IDataReader*
 	const auto table_off = size;
 	size += header.total_entry * sizeof(Entry);
 	const auto data_off = size;
-	size += header.total_block * DATA_BLOCK_SIZE;
+	size += header.total_block << bits;
+	header.metadata_size = config.metadata.size();
+	size += header.metadata_size;
 
 	MemMap res(path.c_str(), false, true, size);
 	if (!res) {
@@ -794,9 +2756,10 @@ bool Estuary::Create(const std::string& path, const Config& config, IDataReader*
 	auto table = (uint64_t*)(res.addr()+table_off);
 	auto data = res.addr() + data_off;
 
-	auto blk = [data](size_t idx)->uint8_t* {
-		return data + idx*DATA_BLOCK_SIZE;
+	auto blk = [data, bits](size_t idx)->uint8_t* {
+		return data + (idx << bits);
 	};
+	memcpy(blk(header.total_block), config.metadata.data(), config.metadata.size());
 
 	*meta = header;
 	if (!InitLocks(locks, header.lock_mask)) {
@@ -807,35 +2770,68 @@ bool Estuary::Create(const std::string& path, const Config& config, IDataReader*
 		*(Entry*)(table+i) = CLEAN_ENTRY;
 	}
 
+	Divisor<uint64_t> total_entry(header.total_entry);
+	size_t duplicate = 0;
 	if (source != nullptr) {
-		Divisor<uint64_t> total_entry(header.total_entry);
+		const auto stamp = CurrentStamp();
 		source->reset();
 		auto total = source->total();
 		if (total > config.item_limit) {
 			Logger::Printf("too many items\n");
 			return false;
 		}
+		std::string key_buf;
+		std::string val_buf;
 		for (size_t i = 0; i < total; i++) {
 			auto rec = source->read();
+			if (config.key_transform != nullptr && rec.key.ptr != nullptr) {
+				config.key_transform(rec.key, key_buf);
+				rec.key = {(const uint8_t*)key_buf.data(), key_buf.size()};
+			}
 			if (rec.key.ptr == nullptr || rec.key.len == 0 || rec.key.len > config.max_key_len
 				|| (rec.val.len != 0 && rec.val.ptr == nullptr) || rec.val.len > config.max_val_len) {
 				Logger::Printf("broken item\n");
 				return false;
 			}
+			if (config.validator != nullptr && !config.validator(rec.key, rec.val)) {
+				Logger::Printf("invalid item\n");
+				return false;
+			}
 			bool done = false;
-			SearchInTable([&rec, meta, &blk, init_end, &done](Entry& ent, uint32_t tag)->bool{
+			SearchInTable([&](Entry& ent, uint32_t tag)->bool{
 					const auto e = ent;
 					if (IsEmpty(e)) {
 						meta->item++;
 						meta->clean_entry--;
 					} else if (e.tag == tag && KeyMatch(rec.key, blk(e.blk))) {
-						const auto bcnt = RecordBlocks(blk(e.blk));
+						duplicate++;
+						switch (config.on_duplicate) {
+							case Config::KEEP_LAST:
+								break;
+							case Config::KEEP_FIRST:
+								done = true;
+								return true;
+							case Config::MERGE:
+								val_buf.assign((const char*)RcVal(blk(e.blk)), Rc(blk(e.blk)).vlen);
+								if (config.duplicate_merger != nullptr
+									&& config.duplicate_merger(rec.val, val_buf, true)
+									&& val_buf.size() <= config.max_val_len) {
+									rec.val = {(const uint8_t*)val_buf.data(), val_buf.size()};
+									break;
+								}
+								Logger::Printf("fail to merge duplicate item\n");
+								return true;
+							default:
+								Logger::Printf("duplicate item\n");
+								return true;
+						}
+						const auto bcnt = RecordBlocks(blk(e.blk), extra, bits);
 						Rc(blk(e.blk)) = MarkForEmpty(bcnt);
 						meta->free_block += bcnt;
 					} else {
 						return false;
 					}
-					auto bcnt = RecordBlocks(rec.key.len, rec.val.len);
+					auto bcnt = RecordBlocks(rec.key.len, rec.val.len, extra, bits);
 					auto block = blk(meta->block_cursor);
 					ent = Entry(meta->block_cursor, tag);
 					meta->block_cursor += bcnt;
@@ -848,16 +2844,55 @@ bool Estuary::Create(const std::string& path, const Config& config, IDataReader*
 					Rc(block).vlen = rec.val.len;
 					memcpy(RcKey(block), rec.key.ptr, rec.key.len);
 					memcpy(RcVal(block), rec.val.ptr, rec.val.len);
+					if (config.record_stamp) {
+						*(uint64_t*)RcExtra(block) = stamp;
+					}
+					if (record_ttl) {
+						*(uint64_t*)(RcExtra(block) + (config.record_stamp? sizeof(uint64_t) : 0)) =
+							header.default_ttl != 0? stamp + header.default_ttl : 0;
+					}
 					done = true;
 					return true;
-				}, Hash(rec.key.ptr, rec.key.len, header.seed), (Entry*)table, total_entry);
+				}, hash(rec.key.ptr, rec.key.len), (Entry*)table, total_entry);
 			if (UNLIKELY(!done)) {
 				return false;
 			}
 		}
+		if (duplicate != 0) {
+			Logger::Printf("%lu duplicate items\n", duplicate);
+		}
 	}
 
 	Rc(blk(meta->block_cursor)) = MarkForEmpty(meta->total_block - meta->block_cursor);
+
+	if (report != nullptr) {
+		*report = BuildReport();
+		report->item = meta->item;
+		report->duplicate = duplicate;
+		size_t probe_sum = 0;
+		for (size_t i = 0; i < header.total_entry; i++) {
+			const auto e = *(const Entry*)(table+i);
+			if (IsEmpty(e)) {
+				continue;
+			}
+			auto block = blk(e.blk);
+			const auto bytes = RecordBlocks(block, extra, bits) << bits;
+			report->data_used += bytes;
+			report->padding += bytes - (sizeof(uint32_t) + Rc(block).klen + Rc(block).vlen + extra);
+			const size_t home = hash(RcKey(block), Rc(block).klen) % total_entry;
+			const size_t probe = i >= home? i - home : i + header.total_entry - home;
+			report->max_probe = std::max(report->max_probe, probe);
+			probe_sum += probe;
+		}
+		if (report->item != 0) {
+			report->avg_probe = probe_sum / (double)report->item;
+		}
+		const size_t reserved = RecordBlocks(config.max_key_len, config.max_val_len, extra, bits) * 2;
+		const size_t total_reserved = reserved + (header.total_block - reserved) / config.data_reserve_factor;
+		if (meta->free_block > total_reserved) {
+			report->data_free = (meta->free_block - total_reserved) << bits;
+		}
+	}
 	return true;
 }
 
@@ -125,4 +125,63 @@ uint64_t Hash(const uint8_t* msg, uint8_t len, uint64_t seed) noexcept {
 	return a;
 }
 
+//wyhash final4, see https://github.com/wangyi-fudan/wyhash
+static FORCE_INLINE void WyMum(uint64_t& a, uint64_t& b) {
+	__uint128_t r = a;
+	r *= b;
+	a = (uint64_t)r;
+	b = (uint64_t)(r >> 64U);
+}
+
+static FORCE_INLINE uint64_t WyMix(uint64_t a, uint64_t b) {
+	WyMum(a, b);
+	return a ^ b;
+}
+
+static FORCE_INLINE uint64_t WyR3(const uint8_t* p, unsigned k) {
+	return (((uint64_t)p[0]) << 16U) | (((uint64_t)p[k>>1U]) << 8U) | p[k-1];
+}
+
+uint64_t WyHash(const uint8_t* msg, uint8_t len, uint64_t seed) noexcept {
+	constexpr uint64_t secret[4] = {
+		0x2d358dccaa6c78a5ULL, 0x8bb84b93962eacc9ULL, 0x4b33a62ed433d4a3ULL, 0x4d5a2da51de1aa47ULL
+	};
+	seed ^= WyMix(seed ^ secret[0], secret[1]);
+	uint64_t a = 0, b = 0;
+	if (len <= 16) {
+		if (len >= 4) {
+			const unsigned d = (len >> 3U) << 2U;
+			a = (((uint64_t)*(uint32_t*)msg) << 32U) | *(uint32_t*)(msg+d);
+			b = (((uint64_t)*(uint32_t*)(msg+len-4)) << 32U) | *(uint32_t*)(msg+len-4-d);
+		} else if (len > 0) {
+			a = WyR3(msg, len);
+		}
+	} else {
+		const uint8_t* p = msg;
+		unsigned i = len;
+		if (i >= 48) {
+			uint64_t see1 = seed, see2 = seed;
+			do {
+				seed = WyMix(*(uint64_t*)p ^ secret[1], *(uint64_t*)(p+8) ^ seed);
+				see1 = WyMix(*(uint64_t*)(p+16) ^ secret[2], *(uint64_t*)(p+24) ^ see1);
+				see2 = WyMix(*(uint64_t*)(p+32) ^ secret[3], *(uint64_t*)(p+40) ^ see2);
+				p += 48;
+				i -= 48;
+			} while (i >= 48);
+			seed ^= see1 ^ see2;
+		}
+		while (i > 16) {
+			seed = WyMix(*(uint64_t*)p ^ secret[1], *(uint64_t*)(p+8) ^ seed);
+			p += 16;
+			i -= 16;
+		}
+		a = *(uint64_t*)(p+i-16);
+		b = *(uint64_t*)(p+i-8);
+	}
+	a ^= secret[1];
+	b ^= seed;
+	WyMum(a, b);
+	return WyMix(a ^ secret[0] ^ len, b ^ secret[1]);
+}
+
 } //estuary
\ No newline at end of file
@@ -23,6 +23,7 @@
 #include <cstdint>
 #include <chrono>
 #include <exception>
+#include <mutex>
 #include <pthread.h>
 
 #define FORCE_INLINE inline __attribute__((always_inline))
@@ -38,6 +39,7 @@ static_assert(sizeof(uintptr_t)==sizeof(uint64_t));
 
 namespace estuary {
 extern uint64_t Hash(const uint8_t* msg, uint8_t len, uint64_t seed) noexcept;
+extern uint64_t WyHash(const uint8_t* msg, uint8_t len, uint64_t seed) noexcept;
 
 struct LockException : public std::exception {
 	const char* what() const noexcept override;
@@ -63,6 +65,10 @@ public:
 			throw LockException();
 		}
 	};
+	//take over a lock which is already held
+	LockGuard(typename T::LockType* lock, std::adopt_lock_t) noexcept : m_lock(lock) {
+		assert(m_lock != nullptr);
+	}
 	~LockGuard() noexcept {
 		T::Unlock(m_lock);
 	}
@@ -91,12 +97,6 @@ struct _MutexLock {
 };
 using MutexLock = LockGuard<_MutexLock>;
 
-static uint64_t GetSeed() {
-	//return 1596176575357415943ULL;
-	return std::chrono::duration_cast<std::chrono::nanoseconds>(
-			std::chrono::system_clock::now().time_since_epoch()).count();
-}
-
 static FORCE_INLINE void PrefetchForNext(const void* ptr) {
 	__builtin_prefetch(ptr, 0, 3);
 }
@@ -114,11 +114,21 @@ T FORCE_INLINE LoadRelaxed(const T& tgt) {
 	return __atomic_load_n(&tgt, __ATOMIC_RELAXED);
 }
 
+template <typename T>
+T FORCE_INLINE LoadAcquire(const T& tgt) {
+	return __atomic_load_n(&tgt, __ATOMIC_ACQUIRE);
+}
+
 template <typename T>
 void FORCE_INLINE StoreRelease(T& tgt, T val) {
 	__atomic_store_n(&tgt, val, __ATOMIC_RELEASE);
 }
 
+template <typename T>
+void FORCE_INLINE StoreRelaxed(T& tgt, T val) {
+	__atomic_store_n(&tgt, val, __ATOMIC_RELAXED);
+}
+
 template <typename T>
 T FORCE_INLINE AddRelaxed(T& tgt, T val) {
 	return __atomic_fetch_add(&tgt, val, __ATOMIC_RELAXED);
@@ -133,5 +143,13 @@ void FORCE_INLINE MemoryBarrier() {
 	__atomic_thread_fence(__ATOMIC_SEQ_CST);
 }
 
+void FORCE_INLINE AcquireFence() {
+	__atomic_thread_fence(__ATOMIC_ACQUIRE);
+}
+
+void FORCE_INLINE ReleaseFence() {
+	__atomic_thread_fence(__ATOMIC_RELEASE);
+}
+
 } //estuary
 #endif //ESTUARY_INTERNAL_H
\ No newline at end of file
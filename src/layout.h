@@ -0,0 +1,164 @@
+//==============================================================================
+// Dictionary designed for read-mostly scene.
+// Copyright (C) 2020  Ruan Kunliang
+//
+// This library is free software; you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation; either version 2.1 of the License, or (at your option)
+// any later version.
+//
+// This library is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+//==============================================================================
+
+#pragma once
+#ifndef ESTUARY_LAYOUT_H
+#define ESTUARY_LAYOUT_H
+
+#include <cassert>
+#include <cstdint>
+#include <cstring>
+#include <utils.h>
+#include "internal.h"
+
+namespace estuary {
+
+static constexpr size_t DATA_BLOCK_SIZE = 8;
+static_assert((DATA_BLOCK_SIZE % sizeof(uint64_t)) == 0);
+//block size can be enlarged to DATA_BLOCK_SIZE << MAX_BLOCK_SHIFT
+static constexpr unsigned DATA_BLOCK_BITS = 3;
+static constexpr unsigned MAX_BLOCK_SHIFT = 3;
+static_assert(DATA_BLOCK_SIZE == (1U << DATA_BLOCK_BITS));
+
+static constexpr unsigned ADDR_BITWIDTH = 43;
+static constexpr size_t DATA_BLOCK_LIMIT = (1ULL << ADDR_BITWIDTH) - 2U;
+
+union RecordMark {
+	struct {
+		uint32_t klen : 8;
+		uint32_t vlen : 24;
+		uint8_t part[4];
+	};
+	struct {
+		uint64_t klen_ : 8;
+		uint64_t bcnt : 56;
+	};
+};
+
+static FORCE_INLINE RecordMark& Rc(uint8_t* block) {
+	return *(RecordMark*)block;
+}
+static FORCE_INLINE uint8_t* RcKey(uint8_t* block) {
+	return block + sizeof(uint32_t);
+}
+static FORCE_INLINE uint8_t* RcVal(uint8_t* block) {
+	return block + sizeof(uint32_t) + Rc(block).klen;
+}
+
+static FORCE_INLINE bool KeyMatch(Slice key, uint8_t* block) {
+	if (Rc(block).klen != key.len) {
+		return false;
+	} else if (key.len == sizeof(uint64_t)) {
+		return *(const uint64_t*)key.ptr == *(const uint64_t*)RcKey(block);
+	} else {
+		return memcmp(key.ptr, RcKey(block), key.len) == 0;
+	}
+}
+static FORCE_INLINE bool ValMatch(Slice val, uint8_t* block) {
+	return Rc(block).vlen == val.len
+		   && memcmp(val.ptr, RcVal(block), val.len) == 0;
+}
+
+static FORCE_INLINE uint8_t* RcExtra(uint8_t* block) {
+	return RcVal(block) + Rc(block).vlen;
+}
+
+static FORCE_INLINE size_t RecordBlocks(size_t klen, size_t vlen, size_t extra, unsigned bits) {
+	assert(klen != 0);
+	return ((sizeof(uint32_t)+klen+vlen+extra)+((1ULL<<bits)-1U)) >> bits;
+}
+static FORCE_INLINE size_t RecordBlocks(uint8_t* block, size_t extra, unsigned bits) {
+	return RecordBlocks(Rc(block).klen, Rc(block).vlen, extra, bits);
+}
+
+static_assert(ADDR_BITWIDTH < 63U);
+static constexpr unsigned TAG_BITWIDTH = 63U - ADDR_BITWIDTH;
+
+struct Entry {
+	uint64_t blk : ADDR_BITWIDTH;
+	uint64_t fit : 1;
+	uint64_t tag : TAG_BITWIDTH;
+	Entry() = default;
+	explicit constexpr Entry(uint64_t b, uint64_t t=(1UL<<TAG_BITWIDTH)-1U) : blk(b), fit(0), tag(t) {}
+	FORCE_INLINE void store_release(Entry e) const noexcept {
+		union {
+			Entry e;
+			uint64_t u;
+		} t = { .e = e };
+		StoreRelease(*(uint64_t*)this, t.u);
+	}
+	FORCE_INLINE void load_relaxed(const Entry& e) noexcept {
+		union {
+			Entry e;
+			uint64_t u;
+		} t = { .u = LoadRelaxed(*(const uint64_t*)&e) };
+		*this = t.e;
+	}
+};
+static_assert(sizeof(Entry)==sizeof(uint64_t));
+
+static constexpr uint64_t MAX_ADDR = (1ULL << ADDR_BITWIDTH) - 1U;
+static constexpr uint64_t RESERVED_ADDR = (1ULL << ADDR_BITWIDTH) - 2U;
+static constexpr Entry CLEAN_ENTRY = Entry(MAX_ADDR);
+static constexpr Entry DELETED_ENTRY = Entry(RESERVED_ADDR);
+
+static_assert(DATA_BLOCK_LIMIT <= RESERVED_ADDR);
+
+static FORCE_INLINE bool IsEmpty(Entry ent) noexcept {
+	return ent.blk >= RESERVED_ADDR;
+}
+static FORCE_INLINE bool IsClean(Entry ent) noexcept {
+	return ent.blk > RESERVED_ADDR;
+}
+
+static_assert(TAG_BITWIDTH >= 16U && TAG_BITWIDTH <= 32U);
+
+static FORCE_INLINE RecordMark MarkForEmpty(size_t bcnt) {
+	RecordMark mark;
+	mark.klen = 0;
+	mark.bcnt = bcnt;
+	return mark;
+}
+
+static inline void FillRecord(uint8_t* block, Slice key, Slice val) {
+	//mark should be updated atomically
+	RecordMark mark;
+	mark.klen = key.len;
+	mark.vlen = val.len;
+	for (unsigned i = 0; i < 4; i++) {
+		if (LIKELY(key.len > 0)) {
+			mark.part[i] = *key.ptr++;
+			key.len--;
+		} else if (val.len > 0) {
+			mark.part[i] = *val.ptr++;
+			val.len--;
+		}
+	}
+	auto buf = block + 8;
+	if (key.len > 0) {
+		memcpy(buf, key.ptr, key.len);
+		buf += key.len;
+	}
+	if (val.len > 0) {
+		memcpy(buf, val.ptr, val.len);
+	}
+	Rc(block) = mark;
+}
+
+} //estuary
+#endif //ESTUARY_LAYOUT_H
@@ -233,8 +233,7 @@ bool LuckyEstuary::update(const uint8_t* key, const uint8_t* val) const {
 }
 
 static FORCE_INLINE int64_t GetStamp() {
-	return std::chrono::time_point_cast<std::chrono::milliseconds>(
-		std::chrono::system_clock::now()).time_since_epoch().count();
+	return Clock::Now() / 1000U;
 }
 
 bool LuckyEstuary::_update(const uint8_t* key, const uint8_t* val) const {
@@ -433,7 +432,7 @@ bool LuckyEstuary::Create(const std::string& path, const Config& config, IDataRe
 	header.val_len = config.val_len;
 	header.total_entry = config.entry;
 	header.capacity = config.capacity;
-	header.seed = GetSeed();
+	header.seed = Clock::Seed();
 
 	static_assert(sizeof(Meta) % sizeof(uintptr_t) == 0, "alignment check");
 
@@ -0,0 +1,109 @@
+//==============================================================================
+// Dictionary designed for read-mostly scene.
+// Copyright (C) 2020  Ruan Kunliang
+//
+// This library is free software; you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation; either version 2.1 of the License, or (at your option)
+// any later version.
+//
+// This library is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+//==============================================================================
+
+#include <ctime>
+#include "stats.h"
+
+namespace estuary {
+
+static FORCE_INLINE int64_t CoarseSecond() {
+	timespec ts;
+	clock_gettime(CLOCK_MONOTONIC_COARSE, &ts);
+	return ts.tv_sec;
+}
+
+StatsRecorder::StatsRecorder() noexcept {
+	for (unsigned i = 0; i < KIND_COUNT; i++) {
+		m_total[i] = 0;
+	}
+	for (auto& slot : m_slots) {
+		slot.sec = -1;
+		for (unsigned i = 0; i < KIND_COUNT; i++) {
+			slot.cnt[i] = 0;
+		}
+	}
+}
+
+void StatsRecorder::add(Kind kind, uint64_t n) noexcept {
+	AddRelaxed(m_total[kind], n);
+	const auto sec = CoarseSecond();
+	auto& slot = m_slots[sec & (SLOT_COUNT-1)];
+	auto old = LoadRelaxed(slot.sec);
+	if (UNLIKELY(old != sec)) {
+		if (__atomic_compare_exchange_n(&slot.sec, &old, sec, false, __ATOMIC_ACQ_REL, __ATOMIC_RELAXED)) {
+			for (unsigned i = 0; i < KIND_COUNT; i++) {
+				StoreRelease(slot.cnt[i], (uint64_t)0U);
+			}
+		}
+	}
+	AddRelaxed(slot.cnt[kind], n);
+}
+
+void StatsRecorder::sum(unsigned window, uint64_t out[KIND_COUNT]) const noexcept {
+	if (window == 0) {
+		for (unsigned i = 0; i < KIND_COUNT; i++) {
+			out[i] = LoadRelaxed(m_total[i]);
+		}
+		return;
+	}
+	for (unsigned i = 0; i < KIND_COUNT; i++) {
+		out[i] = 0;
+	}
+	if (window > MAX_WINDOW) {
+		window = MAX_WINDOW;
+	}
+	const auto now = CoarseSecond();
+	for (auto& slot : m_slots) {
+		const auto sec = LoadRelaxed(slot.sec);
+		if (sec > now - (int64_t)window && sec <= now) {
+			for (unsigned i = 0; i < KIND_COUNT; i++) {
+				out[i] += LoadRelaxed(slot.cnt[i]);
+			}
+		}
+	}
+}
+
+LatencyRecorder::LatencyRecorder() noexcept {
+	for (auto& histogram : m_histograms) {
+		for (unsigned i = 0; i < BUCKET_COUNT; i++) {
+			histogram.cnt[i] = 0;
+		}
+	}
+}
+
+uint64_t LatencyRecorder::Now() noexcept {
+	timespec ts;
+	clock_gettime(CLOCK_MONOTONIC, &ts);
+	return ts.tv_sec * 1000000000ULL + ts.tv_nsec;
+}
+
+void LatencyRecorder::add(Kind kind, uint64_t ns) noexcept {
+	unsigned idx = ns == 0? 0 : 63U - __builtin_clzll(ns);
+	if (idx >= BUCKET_COUNT) {
+		idx = BUCKET_COUNT - 1;
+	}
+	AddRelaxed(m_histograms[kind].cnt[idx], (uint64_t)1U);
+}
+
+void LatencyRecorder::copy(Kind kind, uint64_t out[BUCKET_COUNT]) const noexcept {
+	for (unsigned i = 0; i < BUCKET_COUNT; i++) {
+		out[i] = LoadRelaxed(m_histograms[kind].cnt[i]);
+	}
+}
+
+} //estuary
@@ -0,0 +1,104 @@
+//==============================================================================
+// Dictionary designed for read-mostly scene.
+// Copyright (C) 2020  Ruan Kunliang
+//
+// This library is free software; you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation; either version 2.1 of the License, or (at your option)
+// any later version.
+//
+// This library is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+//==============================================================================
+
+#pragma once
+#ifndef ESTUARY_STATS_H
+#define ESTUARY_STATS_H
+
+#include <cstdint>
+#include "internal.h"
+
+namespace estuary {
+
+//counters with per-second slots, counts may be slightly lost at slot switching
+class StatsRecorder final {
+public:
+	enum Kind : unsigned {
+		FETCH_HIT, FETCH_MISS, UPDATE, ERASE, REJECT, FETCH_RETRY, FETCH_RETRY_HIT,
+		LOGICAL_BYTE, DATA_BYTE, EVICT,
+		KIND_COUNT
+	};
+	static constexpr unsigned MAX_WINDOW = 60;
+
+	StatsRecorder() noexcept;
+	void add(Kind kind, uint64_t n=1) noexcept;
+	//window == 0 means all time
+	void sum(unsigned window, uint64_t out[KIND_COUNT]) const noexcept;
+
+private:
+	static constexpr unsigned SLOT_COUNT = 64;
+	static_assert(SLOT_COUNT > MAX_WINDOW && (SLOT_COUNT&(SLOT_COUNT-1)) == 0);
+	struct alignas(CACHE_BLOCK_SIZE) Slot {
+		int64_t sec;
+		uint64_t cnt[KIND_COUNT];
+	};
+	alignas(CACHE_BLOCK_SIZE) uint64_t m_total[KIND_COUNT];
+	Slot m_slots[SLOT_COUNT];
+
+	StatsRecorder(const StatsRecorder&) noexcept = delete;
+	StatsRecorder& operator=(const StatsRecorder&) noexcept = delete;
+};
+
+//lock-free latency histograms with power-of-2 buckets in nanoseconds
+class LatencyRecorder final {
+public:
+	enum Kind : unsigned {
+		FETCH, WRITE,
+		KIND_COUNT
+	};
+	static constexpr unsigned BUCKET_COUNT = 40;
+
+	LatencyRecorder() noexcept;
+	void add(Kind kind, uint64_t ns) noexcept;
+	void copy(Kind kind, uint64_t out[BUCKET_COUNT]) const noexcept;
+
+	//measure the lifetime, do nothing with null recorder
+	class Timer final {
+	public:
+		Timer(LatencyRecorder* recorder, Kind kind) noexcept : m_recorder(recorder), m_kind(kind) {
+			if (UNLIKELY(m_recorder != nullptr)) {
+				m_start = Now();
+			}
+		}
+		~Timer() noexcept {
+			if (UNLIKELY(m_recorder != nullptr)) {
+				m_recorder->add(m_kind, Now() - m_start);
+			}
+		}
+	private:
+		LatencyRecorder* m_recorder;
+		Kind m_kind;
+		uint64_t m_start = 0;
+		Timer(const Timer&) noexcept = delete;
+		Timer& operator=(const Timer&) noexcept = delete;
+	};
+
+private:
+	struct alignas(CACHE_BLOCK_SIZE) Histogram {
+		uint64_t cnt[BUCKET_COUNT];
+	};
+	Histogram m_histograms[KIND_COUNT];
+
+	static uint64_t Now() noexcept;
+
+	LatencyRecorder(const LatencyRecorder&) noexcept = delete;
+	LatencyRecorder& operator=(const LatencyRecorder&) noexcept = delete;
+};
+
+} //estuary
+#endif //ESTUARY_STATS_H
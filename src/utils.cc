@@ -18,6 +18,10 @@
 
 #include <cerrno>
 #include <cstdio>
+#include <cstring>
+#include <algorithm>
+#include <memory>
+#include <chrono>
 #include <fcntl.h>
 #include <unistd.h>
 #include <sys/mman.h>
@@ -47,6 +51,108 @@ void Logger::Printf(const char* format, ... ) {
 	}
 }
 
+Clock* Clock::s_instance = nullptr;
+
+uint64_t Clock::Now() {
+	if (s_instance != nullptr) {
+		return s_instance->now();
+	}
+	return std::chrono::duration_cast<std::chrono::microseconds>(
+			std::chrono::system_clock::now().time_since_epoch()).count();
+}
+
+uint64_t Clock::Seed() {
+	if (s_instance != nullptr) {
+		return s_instance->seed();
+	}
+	//return 1596176575357415943ULL;
+	return std::chrono::duration_cast<std::chrono::nanoseconds>(
+			std::chrono::system_clock::now().time_since_epoch()).count();
+}
+
+//return length of class pattern, 0 for broken one
+static size_t MatchClass(Slice pattern, uint8_t ch, bool& hit) noexcept {
+	size_t i = 1;
+	bool negative = false;
+	if (i < pattern.len && (pattern.ptr[i] == '!' || pattern.ptr[i] == '^')) {
+		negative = true;
+		i++;
+	}
+	hit = false;
+	for (bool first = true; i < pattern.len; first = false) {
+		auto lo = pattern.ptr[i];
+		if (lo == ']' && !first) {
+			hit ^= negative;
+			return i + 1;
+		}
+		if (lo == '\\' && i+1 < pattern.len) {
+			lo = pattern.ptr[++i];
+		}
+		auto hi = lo;
+		if (i+2 < pattern.len && pattern.ptr[i+1] == '-' && pattern.ptr[i+2] != ']') {
+			i += 2;
+			hi = pattern.ptr[i];
+			if (hi == '\\' && i+1 < pattern.len) {
+				hi = pattern.ptr[++i];
+			}
+		}
+		if (lo <= ch && ch <= hi) {
+			hit = true;
+		}
+		i++;
+	}
+	return 0;
+}
+
+bool GlobMatch(Slice pattern, Slice text) noexcept {
+	size_t p = 0, t = 0;
+	size_t star_p = SIZE_MAX, star_t = 0;
+	while (t < text.len) {
+		if (p < pattern.len) {
+			auto ch = pattern.ptr[p];
+			if (ch == '*') {
+				star_p = ++p;
+				star_t = t;
+				continue;
+			} else if (ch == '?') {
+				p++;
+				t++;
+				continue;
+			} else if (ch == '[') {
+				bool hit = false;
+				auto n = MatchClass({pattern.ptr+p, pattern.len-p}, text.ptr[t], hit);
+				if (n == 0) {
+					hit = text.ptr[t] == '[';
+					n = 1;
+				}
+				if (hit) {
+					p += n;
+					t++;
+					continue;
+				}
+			} else {
+				if (ch == '\\' && p+1 < pattern.len) {
+					ch = pattern.ptr[++p];
+				}
+				if (ch == text.ptr[t]) {
+					p++;
+					t++;
+					continue;
+				}
+			}
+		}
+		if (star_p == SIZE_MAX) {
+			return false;
+		}
+		p = star_p;
+		t = ++star_t;
+	}
+	while (p < pattern.len && pattern.ptr[p] == '*') {
+		p++;
+	}
+	return p == pattern.len;
+}
+
 MemMap::MemMap(const char* path, bool populate, bool exclusive, size_t size) noexcept {
 	int fd = -1;
 	if (size == 0) {
@@ -94,26 +200,34 @@ static inline constexpr size_t RoundUp(size_t n) {
 	return (n+m)&(~m);
 };
 
-static bool Read(int fd, uint8_t* data, size_t size) noexcept {
-	constexpr size_t block = 16*1024*1024;
+static constexpr size_t IO_BLOCK = 16*1024*1024;
+
+static bool Read(int fd, uint8_t* data, size_t size, const Progress& progress) noexcept {
+	const auto total = size;
 	size_t off = 0;
-	while (size > block) {
-		auto next = off + block;
-		readahead(fd, next, block);
-		if (pread(fd, data, block, off) != block) {
+	while (size > IO_BLOCK) {
+		auto next = off + IO_BLOCK;
+		readahead(fd, next, IO_BLOCK);
+		if (pread(fd, data, IO_BLOCK, off) != IO_BLOCK) {
 			return false;
 		}
 		off = next;
-		data += block;
-		size -= block;
+		data += IO_BLOCK;
+		size -= IO_BLOCK;
+		if (progress != nullptr) {
+			progress(off, total);
+		}
 	}
 	if (pread(fd, data, size, off) != size) {
 		return false;
 	}
+	if (progress != nullptr) {
+		progress(total, total);
+	}
 	return true;
 }
 
-MemMap::MemMap(const char* path, LoadByCopy) {
+MemMap::MemMap(const char* path, LoadByCopy, const Progress& progress) {
 	auto fd = open(path, O_RDWR);
 	if (fd < 0) {
 		Logger::Printf("fail to open file: %s\n", path);
@@ -142,7 +256,7 @@ MemMap::MemMap(const char* path, LoadByCopy) {
 		close(fd);
 		return;
 	}
-	if (!Read(fd, (uint8_t*)addr, stat.st_size)) {
+	if (!Read(fd, (uint8_t*)addr, stat.st_size, progress)) {
 		Logger::Printf("fail to read file: %s\n", path);
 		munmap(addr, round_up_size);
 	} else {
@@ -164,26 +278,69 @@ MemMap::~MemMap() noexcept {
 	}
 }
 
-bool MemMap::dump(const char* path) const noexcept {
+bool MemMap::protect(size_t off, bool writable) noexcept {
+	if (m_addr == nullptr) {
+		return false;
+	}
+	const size_t page = sysconf(_SC_PAGESIZE);
+	off = (off + page - 1) & ~(page - 1);
+	if (off >= m_size) {
+		return true;
+	}
+	if (mprotect(m_addr+off, m_size-off, writable? PROT_READ|PROT_WRITE : PROT_READ) != 0) {
+		Logger::Printf("fail to mprotect[%d]: %p | %lu\n", errno, m_addr+off, m_size-off);
+		return false;
+	}
+	return true;
+}
+
+//read file back from disk rather than page cache and compare with memory
+static bool Verify(int fd, const uint8_t* data, size_t size) noexcept {
+	if (fsync(fd) != 0) {
+		return false;
+	}
+	posix_fadvise(fd, 0, 0, POSIX_FADV_DONTNEED);
+	std::unique_ptr<uint8_t[]> buf(new(std::nothrow) uint8_t[IO_BLOCK]);
+	if (buf == nullptr) {
+		return false;
+	}
+	for (size_t off = 0; off < size; off += IO_BLOCK) {
+		const auto len = std::min(size - off, IO_BLOCK);
+		if (pread(fd, buf.get(), len, off) != len || memcmp(buf.get(), data+off, len) != 0) {
+			return false;
+		}
+	}
+	return true;
+}
+
+NOINLINE bool MemMap::dump(const char* path, const Progress& progress, bool verify) const noexcept {
 	if (!*this) {
 		return false;
 	}
-	auto fd = open(path, O_CREAT|O_TRUNC|O_WRONLY, 0644);
+	auto fd = open(path, O_CREAT|O_TRUNC|(verify? O_RDWR : O_WRONLY), 0644);
 	if (fd < 0) {
 		Logger::Printf("fail to open file: %s\n", path);
 		return false;
 	}
 	ssize_t remain = m_size;
 	for (auto buf = m_addr; remain > 0;) {
-		auto sz = write(fd, buf, remain);
+		auto sz = write(fd, buf, std::min<size_t>(remain, IO_BLOCK));
 		if (sz < 0) {
 			break;
 		}
 		buf += sz;
 		remain -= sz;
+		if (progress != nullptr) {
+			progress(m_size - remain, m_size);
+		}
+	}
+	bool done = remain == 0;
+	if (done && verify && !Verify(fd, m_addr, m_size)) {
+		Logger::Printf("fail to verify file: %s\n", path);
+		done = false;
 	}
 	close(fd);
-	return remain == 0;
+	return done;
 }
 
 } //estuary
@@ -85,3 +85,15 @@ private:
 	const unsigned m_shift;
 };
 
+
+//bind a clock within the scope
+class ClockBinding {
+public:
+	explicit ClockBinding(estuary::Clock* clock) : m_old(estuary::Clock::Bind(clock)) {}
+	~ClockBinding() { estuary::Clock::Bind(m_old); }
+	ClockBinding(const ClockBinding&) = delete;
+	ClockBinding& operator=(const ClockBinding&) = delete;
+
+private:
+	estuary::Clock* m_old;
+};
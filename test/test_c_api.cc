@@ -0,0 +1,74 @@
+//==============================================================================
+// Dictionary designed for read-mostly scene.
+// Copyright (C) 2020  Ruan Kunliang
+//
+// This library is free software; you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation; either version 2.1 of the License, or (at your option)
+// any later version.
+//
+// This library is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+//==============================================================================
+
+#include <string>
+#include <gtest/gtest.h>
+#include <estuary.h>
+#include <estuary_c.h>
+#include "test.h"
+
+TEST(CApi, FetchAndUpdate) {
+	const std::string filename = "c_api.es";
+	estuary::Estuary::Config config;
+	config.item_limit = 1000;
+	config.max_key_len = 8;
+	config.max_val_len = UINT8_MAX;
+	config.avg_size_per_item = 64;
+	config.concurrency = 1;
+	VariedValueGenerator source(0, 100, 1);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	ASSERT_EQ(estuary_open("none.es", ESTUARY_SHARED), nullptr);
+	ASSERT_EQ(estuary_open(filename.c_str(), 5), nullptr);
+	auto es = estuary_open(filename.c_str(), ESTUARY_SHARED);
+	ASSERT_NE(es, nullptr);
+	ASSERT_EQ(estuary_item(es), 100);
+	ASSERT_EQ(estuary_max_key_len(es), 8);
+	ASSERT_EQ(estuary_max_val_len(es), UINT8_MAX);
+
+	uint64_t key = 7;
+	char buf[UINT8_MAX+1];
+	ASSERT_EQ(estuary_fetch(es, &key, sizeof(key), buf, 2), 8);	//too small
+	ASSERT_EQ(estuary_fetch(es, &key, sizeof(key), buf, sizeof(buf)), 8);
+	ASSERT_EQ(std::string(buf, 8), std::string(8, 8));
+
+	ASSERT_EQ(estuary_update(es, &key, sizeof(key), "abc", 3), 1);
+	ASSERT_EQ(estuary_fetch(es, &key, sizeof(key), buf, sizeof(buf)), 3);
+	ASSERT_EQ(std::string(buf, 3), "abc");
+	ASSERT_EQ(estuary_update(es, &key, sizeof(key), buf, sizeof(buf)+1), 0);
+	ASSERT_EQ(estuary_erase(es, &key, sizeof(key)), 1);
+	ASSERT_EQ(estuary_erase(es, &key, sizeof(key)), 0);
+	ASSERT_EQ(estuary_fetch(es, &key, sizeof(key), buf, sizeof(buf)), -1);
+	ASSERT_EQ(estuary_item(es), 99);
+	estuary_close(es);
+
+	ASSERT_EQ(estuary_fetch(nullptr, &key, sizeof(key), buf, sizeof(buf)), -2);
+	estuary_close(nullptr);
+}
+
+TEST(CApi, Create) {
+	const std::string filename = "c_api_create.es";
+	ASSERT_EQ(estuary_create(nullptr, 1000, 8, 64, 32), -2);
+	ASSERT_EQ(estuary_create(filename.c_str(), 1000, 0, 64, 32), -2);
+	ASSERT_EQ(estuary_create(filename.c_str(), 1000, 8, 64, 32), 0);
+	auto es = estuary_open(filename.c_str(), ESTUARY_MONOPOLY);
+	ASSERT_NE(es, nullptr);
+	ASSERT_EQ(estuary_item(es), 0);
+	ASSERT_EQ(estuary_max_val_len(es), 64);
+	estuary_close(es);
+}
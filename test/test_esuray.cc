@@ -16,7 +16,16 @@
 // along with the This Library; if not, see <https://www.gnu.org/licenses/>.
 //==============================================================================
 
+#include <cstdio>
 #include <string>
+#include <fstream>
+#include <algorithm>
+#include <atomic>
+#include <thread>
+#include <chrono>
+#include <fcntl.h>
+#include <unistd.h>
+#include <sys/stat.h>
 #include <gtest/gtest.h>
 #include <estuary.h>
 #include "test.h"
@@ -56,6 +65,42 @@ TEST(Estuary, BuildAndRead) {
 	ASSERT_FALSE(dict.fetch({junk_key,8}, val));
 }
 
+TEST(Estuary, FetchReuseBuffer) {
+	const std::string filename = "reuse.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	std::string val;
+	val.reserve(CONFIG.max_val_len);
+	const auto buf = val.data();
+	source.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = source.read();
+		ASSERT_TRUE(dict.fetch(rec.key, val));
+		ASSERT_EQ(val.data(), buf);		//no reallocation
+	}
+}
+
+TEST(Estuary, BuildReport) {
+	const std::string filename = "report.es";
+
+	VariedValueGenerator source(0, PIECE);
+	estuary::Estuary::BuildReport report;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source, &report));
+	ASSERT_EQ(report.item, PIECE);
+	ASSERT_EQ(report.duplicate, 0);
+	ASSERT_TRUE(report.padding < report.data_used);
+	ASSERT_TRUE(report.avg_probe <= report.max_probe);
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_EQ(report.data_free, dict.data_free());
+}
+
 TEST(Estuary, Update) {
 	const std::string filename = "update.es";
 
@@ -145,4 +190,2184 @@ TEST(Estuary, Erase) {
 		ASSERT_EQ(val.size(), rec.val.len);
 		ASSERT_EQ(memcmp(val.data(), rec.val.ptr, rec.val.len), 0);
 	}
-}
\ No newline at end of file
+}
+
+TEST(Estuary, UpdateBehindDeleted) {
+	const std::string filename = "update-behind-deleted.es";
+
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	VariedValueGenerator input1(0, PIECE, 5);
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = input1.read();
+		ASSERT_TRUE(dict.update(rec.key, rec.val));
+	}
+	input1.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = input1.read();
+		if (i % 2 == 0) {
+			ASSERT_TRUE(dict.erase(rec.key));
+		}
+	}
+	ASSERT_EQ(dict.item(), PIECE/2);
+
+	//surviving keys may sit behind deleted entries in their chains
+	VariedValueGenerator input2(0, PIECE, 64);
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = input2.read();
+		if (i % 2 != 0) {
+			ASSERT_TRUE(dict.update(rec.key, rec.val));
+		}
+	}
+	ASSERT_EQ(dict.item(), PIECE/2);
+
+	input2.reset();
+	std::string val;
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = input2.read();
+		if (i % 2 != 0) {
+			ASSERT_TRUE(dict.erase(rec.key));
+			ASSERT_FALSE(dict.fetch(rec.key, val));
+		}
+	}
+	ASSERT_EQ(dict.item(), 0U);
+}
+
+TEST(Estuary, UpdateWithDeadline) {
+	const std::string filename = "deadline.es";
+
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	auto deadline = std::chrono::system_clock::now() + std::chrono::seconds(10);
+	VariedValueGenerator input(0, PIECE, 5);
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = input.read();
+		ASSERT_TRUE(dict.update(rec.key, rec.val, deadline));
+	}
+
+	std::string val;
+	input.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = input.read();
+		ASSERT_TRUE(dict.fetch(rec.key, val));
+		ASSERT_EQ(val.size(), rec.val.len);
+		ASSERT_EQ(memcmp(val.data(), rec.val.ptr, rec.val.len), 0);
+	}
+}
+
+TEST(Estuary, UpdateDeadlineTimeout) {
+	const std::string filename = "deadline-timeout.es";
+
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	dict.enable_stats();
+	std::vector<estuary::Estuary::Error> rejects;
+	estuary::Estuary::Hooks hooks;
+	hooks.on_reject = [&rejects](estuary::Slice, estuary::Estuary::Error err) {
+		rejects.push_back(err);
+	};
+	dict.set_hooks(std::move(hooks));
+
+	const uint64_t key = 1;
+	const estuary::Slice k = {(const uint8_t*)&key, sizeof(key)};
+	const estuary::Slice v = {(const uint8_t*)"abc", 3};
+	auto soon = []() {
+		return std::chrono::system_clock::now() + std::chrono::milliseconds(10);
+	};
+	ASSERT_EQ(dict.try_update({nullptr, 0}, v, soon()), estuary::Estuary::Error::BAD_ARGUMENT);
+	std::string long_key(dict.max_key_len()+1, 'x');
+	ASSERT_EQ(dict.try_update({(const uint8_t*)long_key.data(), long_key.size()}, v, soon()),
+			  estuary::Estuary::Error::KEY_TOO_LONG);
+
+	//hold the writer lock for a while
+	std::atomic<bool> locked(false);
+	std::thread holder([&dict, k, &locked]() {
+		dict.update_with(k, [&locked](std::string& val, bool exists)->bool {
+			locked = true;
+			std::this_thread::sleep_for(std::chrono::milliseconds(200));
+			val = "held";
+			return true;
+		});
+	});
+	while (!locked) {
+		std::this_thread::yield();
+	}
+	ASSERT_EQ(dict.try_update(k, v, soon()), estuary::Estuary::Error::TIMEOUT);
+	ASSERT_FALSE(dict.update(k, v, soon()));
+	holder.join();
+
+	ASSERT_EQ(rejects.size(), 2U);
+	ASSERT_EQ(rejects[0], estuary::Estuary::Error::TIMEOUT);
+	ASSERT_EQ(dict.stats().reject, 2U);
+	ASSERT_EQ(dict.try_update(k, v, soon()), estuary::Estuary::Error::OK);
+	std::string val;
+	ASSERT_TRUE(dict.fetch(k, val));
+	ASSERT_EQ(val, "abc");
+}
+
+TEST(Estuary, StableIteration) {
+	const std::string filename1 = "stable1.es";
+	const std::string filename2 = "stable2.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename1, CONFIG, &source));
+	ASSERT_TRUE(estuary::Estuary::Create(filename2, CONFIG));
+
+	auto dict1 = estuary::Estuary::Load(filename1);
+	ASSERT_FALSE(!dict1);
+	auto dict2 = estuary::Estuary::Load(filename2);
+	ASSERT_FALSE(!dict2);
+
+	for (unsigned i = PIECE; i > 0; i--) {	//different table layout
+		VariedValueGenerator one(i-1, 1);
+		auto rec = one.read();
+		ASSERT_TRUE(dict2.update(rec.key, rec.val));
+	}
+
+	auto collect = [](const estuary::Estuary& dict)->std::string {
+		std::string out;
+		dict.for_each_stable([&out](estuary::Slice key, estuary::Slice val) {
+			out.append((const char*)key.ptr, key.len);
+			out.append((const char*)val.ptr, val.len);
+		}, 12345);
+		return out;
+	};
+	auto stream1 = collect(dict1);
+	auto stream2 = collect(dict2);
+	ASSERT_FALSE(stream1.empty());
+	ASSERT_EQ(stream1, stream2);
+}
+
+TEST(Estuary, Scan) {
+	const std::string filename = "scan.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	std::vector<bool> seen(PIECE, false);
+	std::vector<estuary::Estuary::Item> items;
+	uint64_t cursor = 0;
+	unsigned total = 0;
+	do {
+		cursor = dict.scan(cursor, 64, items);
+		ASSERT_TRUE(items.size() <= 64);
+		for (auto& item : items) {
+			ASSERT_EQ(item.key.size(), sizeof(uint64_t));
+			auto idx = *(const uint64_t*)item.key.data();
+			ASSERT_TRUE(idx < PIECE);
+			ASSERT_FALSE(seen[idx]);
+			seen[idx] = true;
+			total++;
+		}
+	} while (cursor != 0);
+	ASSERT_EQ(total, PIECE);
+}
+
+TEST(Estuary, Keys) {
+	const std::string filename = "keys.es";
+
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	const char* names[] = {"user:1", "user:2", "user:10", "item:1", "item:2"};
+	for (auto name : names) {
+		ASSERT_TRUE(dict.update({(const uint8_t*)name, strlen(name)}, {(const uint8_t*)name, strlen(name)}));
+	}
+
+	auto pattern = [](const char* str)->estuary::Slice {
+		return {(const uint8_t*)str, strlen(str)};
+	};
+	std::vector<std::string> keys;
+	dict.keys(pattern("user:*"), 100, keys);
+	ASSERT_EQ(keys.size(), 3);
+	dict.keys(pattern("*:1"), 100, keys);
+	ASSERT_EQ(keys.size(), 2);
+	dict.keys(pattern("user:?"), 100, keys);
+	ASSERT_EQ(keys.size(), 2);
+	dict.keys(pattern("*"), 4, keys);
+	ASSERT_EQ(keys.size(), 4);
+	dict.keys(pattern("none*"), 100, keys);
+	ASSERT_TRUE(keys.empty());
+
+	//the table is walked in several steps
+	auto config = CONFIG;
+	config.item_limit = PIECE*10;
+	VariedValueGenerator source(0, PIECE*5);
+	ASSERT_TRUE(estuary::Estuary::Create("keys-many.es", config, &source));
+	dict = estuary::Estuary::Load("keys-many.es");
+	ASSERT_FALSE(!dict);
+	dict.keys(pattern("*"), SIZE_MAX, keys);
+	ASSERT_EQ(keys.size(), PIECE*5);
+	std::sort(keys.begin(), keys.end());
+	ASSERT_EQ(std::unique(keys.begin(), keys.end()), keys.end());
+	dict.keys(pattern("*"), PIECE*4+1, keys);
+	ASSERT_EQ(keys.size(), PIECE*4+1);
+}
+
+TEST(Estuary, EmptyValue) {
+	const std::string filename = "empty.es";
+
+	auto config = CONFIG;
+	config.max_val_len = 0;
+	config.avg_size_per_item = sizeof(uint64_t);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_EQ(dict.max_val_len(), 0);
+
+	const uint8_t one = 1;
+	for (uint64_t i = 0; i < PIECE; i++) {
+		ASSERT_TRUE(dict.update({(const uint8_t*)&i, sizeof(i)}, {}));
+	}
+	ASSERT_EQ(dict.item(), PIECE);
+	uint64_t key = 7;
+	ASSERT_FALSE(dict.update({(const uint8_t*)&key, sizeof(key)}, {&one, 1}));
+	ASSERT_TRUE(dict.update({(const uint8_t*)&key, sizeof(key)}, {}));
+
+	std::string val = "x";
+	for (uint64_t i = 0; i < PIECE; i++) {
+		ASSERT_TRUE(dict.fetch({(const uint8_t*)&i, sizeof(i)}, val));
+		ASSERT_TRUE(val.empty());
+	}
+	key = PIECE;
+	ASSERT_FALSE(dict.fetch({(const uint8_t*)&key, sizeof(key)}, val));
+	key = 0;
+	ASSERT_TRUE(dict.erase({(const uint8_t*)&key, sizeof(key)}));
+	ASSERT_FALSE(dict.fetch({(const uint8_t*)&key, sizeof(key)}, val));
+	ASSERT_TRUE(dict.self_test(PIECE*2));
+}
+
+TEST(Estuary, Count) {
+	const std::string filename = "count.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	ASSERT_EQ(dict.count([](estuary::Slice key)->bool { return true; }), PIECE);
+	ASSERT_EQ(dict.count([](estuary::Slice key)->bool {
+		return *(const uint64_t*)key.ptr % 4 == 0;
+	}), PIECE/4);
+}
+
+TEST(Estuary, ExportPrefix) {
+	const std::string filename = "export.es";
+	const std::string another = "import.es";
+	const std::string exported = "export.dat";
+
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG));
+	ASSERT_TRUE(estuary::Estuary::Create(another, CONFIG));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	auto target = estuary::Estuary::Load(another);
+	ASSERT_FALSE(!target);
+
+	auto slice = [](const char* str)->estuary::Slice {
+		return {(const uint8_t*)str, strlen(str)};
+	};
+	const char* names[] = {"user:1", "user:2", "user:10", "item:1", "item:2"};
+	for (auto name : names) {
+		ASSERT_TRUE(dict.update(slice(name), slice(name)));
+	}
+	ASSERT_TRUE(dict.update(slice("user:0"), {}));
+
+	size_t cnt = 0;
+	ASSERT_TRUE(dict.export_prefix(slice("user:"), exported, &cnt));
+	ASSERT_EQ(cnt, 4);
+	estuary::Estuary::IngestOptions options;
+	ASSERT_EQ(target.import_from(exported, options), 4);
+	ASSERT_EQ(target.item(), 4);
+	std::string val;
+	ASSERT_TRUE(target.fetch(slice("user:10"), val));
+	ASSERT_EQ(val, "user:10");
+	ASSERT_TRUE(target.fetch(slice("user:0"), val));
+	ASSERT_TRUE(val.empty());
+	ASSERT_FALSE(target.fetch(slice("item:1"), val));
+
+	ASSERT_TRUE(dict.export_prefix({}, exported, &cnt));
+	ASSERT_EQ(cnt, 6);
+	ASSERT_TRUE(dict.export_prefix(slice("none"), exported, &cnt));
+	ASSERT_EQ(cnt, 0);
+	ASSERT_EQ(target.import_from(exported, options), 0);
+
+	//broken file is refused
+	ASSERT_TRUE(dict.export_prefix(slice("item:"), exported));
+	ASSERT_EQ(truncate(exported.c_str(), 30), 0);
+	ASSERT_EQ(target.import_from(exported, options), 0);
+	ASSERT_EQ(target.item(), 4);
+}
+
+TEST(Estuary, RecordStamp) {
+	const std::string filename = "stamp.es";
+
+	auto config = CONFIG;
+	config.record_stamp = true;
+	auto begin = std::chrono::system_clock::now();
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	std::string val;
+	estuary::Estuary::RecordMeta meta;
+	source.reset();
+	auto rec = source.read();
+	ASSERT_TRUE(dict.fetch_with_meta(rec.key, val, meta));
+	ASSERT_EQ(val.size(), rec.val.len);
+	ASSERT_EQ(memcmp(val.data(), rec.val.ptr, rec.val.len), 0);
+	auto built = meta.mtime;
+	ASSERT_TRUE(built >= std::chrono::time_point_cast<std::chrono::microseconds>(begin));
+	ASSERT_TRUE(built <= std::chrono::system_clock::now());
+
+	std::this_thread::sleep_for(std::chrono::milliseconds(2));
+	VariedValueGenerator input(0, PIECE, 10);
+	for (unsigned i = 0; i < PIECE; i++) {
+		rec = input.read();
+		ASSERT_TRUE(dict.update(rec.key, rec.val));
+	}
+	input.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		rec = input.read();
+		ASSERT_TRUE(dict.fetch_with_meta(rec.key, val, meta));
+		ASSERT_EQ(val.size(), rec.val.len);
+		ASSERT_EQ(memcmp(val.data(), rec.val.ptr, rec.val.len), 0);
+		ASSERT_TRUE(meta.mtime > built);
+	}
+
+	dict = estuary::Estuary();
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+	dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	source.reset();
+	rec = source.read();
+	ASSERT_TRUE(dict.fetch_with_meta(rec.key, val, meta));
+	ASSERT_EQ(meta.mtime, estuary::Estuary::Timestamp());
+}
+
+TEST(Estuary, UpdateSameValue) {
+	const std::string filename = "same-value.es";
+
+	auto config = CONFIG;
+	config.record_stamp = true;
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	source.reset();
+	auto rec = source.read();
+	std::string val;
+	estuary::Estuary::RecordMeta meta;
+	ASSERT_TRUE(dict.fetch_with_meta(rec.key, val, meta));
+	const auto built = meta.mtime;
+	estuary::Estuary::View view;
+	ASSERT_TRUE(dict.fetch_view(rec.key, view));
+	const auto generation = dict.generation();
+
+	std::this_thread::sleep_for(std::chrono::milliseconds(2));
+	ASSERT_TRUE(dict.update(rec.key, rec.val));
+	ASSERT_EQ(dict.generation(), generation);
+	ASSERT_TRUE(dict.view_valid(view));
+	ASSERT_TRUE(dict.fetch_with_meta(rec.key, val, meta));
+	ASSERT_EQ(meta.mtime, built);
+
+	val.assign((const char*)rec.val.ptr, rec.val.len);
+	val[0]++;
+	ASSERT_TRUE(dict.update(rec.key, {(const uint8_t*)val.data(), val.size()}));
+	ASSERT_EQ(dict.generation(), generation+2);
+	ASSERT_FALSE(dict.view_valid(view));
+	ASSERT_TRUE(dict.fetch_with_meta(rec.key, val, meta));
+	ASSERT_TRUE(meta.mtime > built);
+}
+
+TEST(Estuary, FetchIfModifiedSince) {
+	const std::string filename = "modified.es";
+
+	auto config = CONFIG;
+	config.record_stamp = true;
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	VariedValueGenerator input1(0, 1);
+	VariedValueGenerator input2(1, 1);
+	auto rec1 = input1.read();
+	auto rec2 = input2.read();
+
+	std::string val;
+	estuary::Estuary::RecordMeta meta;
+	ASSERT_TRUE(dict.fetch_with_meta(rec1.key, val, meta));
+	ASSERT_EQ(dict.fetch_if_modified_since(rec1.key, meta.mtime, val), estuary::Estuary::NOT_MODIFIED);
+	ASSERT_TRUE(val.empty());
+	ASSERT_EQ(dict.fetch_if_modified_since(rec1.key, meta.mtime-std::chrono::seconds(1), val),
+			  estuary::Estuary::FOUND);
+	ASSERT_EQ(val.size(), rec1.val.len);
+
+	std::this_thread::sleep_for(std::chrono::milliseconds(2));
+	uint8_t tmp[] = {1, 2, 3};
+	ASSERT_TRUE(dict.update(rec2.key, {tmp, sizeof(tmp)}));
+	ASSERT_EQ(dict.fetch_if_modified_since(rec2.key, meta.mtime, val), estuary::Estuary::FOUND);
+	ASSERT_EQ(val.size(), sizeof(tmp));
+
+	uint64_t junk = UINT64_MAX;
+	ASSERT_EQ(dict.fetch_if_modified_since({(const uint8_t*)&junk, sizeof(junk)}, meta.mtime, val),
+			  estuary::Estuary::NOT_FOUND);
+}
+
+TEST(Estuary, Set) {
+	const std::string filename = "set.es";
+
+	auto config = CONFIG;
+	config.record_stamp = true;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	auto str = [](const char* s)->estuary::Slice {
+		return {(const uint8_t*)s, strlen(s)};
+	};
+	ASSERT_TRUE(dict.add_to_set(str("set"), str("a")));
+	ASSERT_TRUE(dict.add_to_set(str("set"), str("bb")));
+
+	//adding a member already there writes nothing
+	std::string val;
+	estuary::Estuary::RecordMeta before, after;
+	ASSERT_TRUE(dict.fetch_with_meta(str("set"), val, before));
+	const auto generation = dict.generation();
+	dict.enable_stats();
+	std::this_thread::sleep_for(std::chrono::milliseconds(2));
+	ASSERT_TRUE(dict.add_to_set(str("set"), str("a")));
+	ASSERT_EQ(dict.generation(), generation);
+	ASSERT_EQ(dict.stats().update, 0);
+	ASSERT_TRUE(dict.fetch_with_meta(str("set"), val, after));
+	ASSERT_TRUE(after.mtime == before.mtime);
+
+	ASSERT_TRUE(dict.add_to_set(str("set"), str("ccc")));
+
+	std::vector<std::string> members;
+	ASSERT_TRUE(dict.members(str("set"), members));
+	ASSERT_EQ(members, std::vector<std::string>({"a", "bb", "ccc"}));
+
+	ASSERT_TRUE(dict.remove_from_set(str("set"), str("bb")));
+	ASSERT_FALSE(dict.remove_from_set(str("set"), str("bb")));
+	ASSERT_TRUE(dict.members(str("set"), members));
+	ASSERT_EQ(members, std::vector<std::string>({"a", "ccc"}));
+	ASSERT_EQ(dict.item(), 1);
+
+	ASSERT_TRUE(dict.remove_from_set(str("set"), str("a")));
+	ASSERT_TRUE(dict.remove_from_set(str("set"), str("ccc")));
+	ASSERT_FALSE(dict.members(str("set"), members));
+	ASSERT_EQ(dict.item(), 0);
+}
+
+TEST(Estuary, Stats) {
+	const std::string filename = "stats.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_EQ(dict.stats().fetch_hit, 0);
+	dict.enable_stats();
+	dict.enable_latency_stats();
+	dict.set_fetch_retry({4, 10});
+
+	std::string val;
+	source.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = source.read();
+		ASSERT_TRUE(dict.fetch(rec.key, val));
+		if (i % 2 == 0) {
+			ASSERT_TRUE(dict.erase(rec.key));
+		}
+	}
+	source.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = source.read();
+		ASSERT_EQ(dict.fetch(rec.key, val), i % 2 != 0);
+	}
+	uint8_t long_key[UINT8_MAX] = {0};
+	ASSERT_FALSE(dict.update({long_key, 10}, {long_key, UINT8_MAX}));
+	ASSERT_TRUE(dict.update({long_key, 1}, {long_key, 1}));
+
+	auto stats = dict.stats();
+	ASSERT_EQ(stats.fetch_hit, PIECE + PIECE/2);
+	ASSERT_EQ(stats.fetch_miss, PIECE/2);
+	ASSERT_EQ(stats.erase, PIECE/2);
+	ASSERT_EQ(stats.update, 1);
+	ASSERT_EQ(stats.fetch_retry, 0);
+	ASSERT_EQ(stats.fetch_retry_hit, 0);
+	ASSERT_EQ(stats.hit_ratio(), 0.75);
+	ASSERT_EQ(stats.logical_byte, 2);
+	ASSERT_TRUE(stats.data_byte >= stats.logical_byte);
+	ASSERT_TRUE(stats.write_amplification() >= 1.0);
+
+	auto latency = dict.fetch_latency();
+	ASSERT_EQ(latency.count(), PIECE*2);
+	ASSERT_TRUE(latency.percentile(0.5) <= latency.percentile(0.99));
+	ASSERT_TRUE(latency.percentile(0.99) != 0);
+	ASSERT_EQ(dict.write_latency().count(), PIECE/2 + 1);	//invalid argument is not counted
+
+	stats = dict.stats(60);
+	ASSERT_TRUE(stats.fetch_hit <= PIECE + PIECE/2);
+	ASSERT_TRUE(stats.fetch_hit + 2 >= PIECE + PIECE/2);
+}
+
+TEST(Estuary, Quarantine) {
+	const std::string filename = "quarantine.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	//damage the key of one record
+	{
+		FILE* fp = fopen(filename.c_str(), "r+b");
+		ASSERT_TRUE(fp != nullptr);
+		std::string content;
+		char buf[4096];
+		for (size_t n; (n = fread(buf, 1, sizeof(buf), fp)) > 0; ) {
+			content.append(buf, n);
+		}
+		const uint64_t key = 500;
+		const uint8_t len = (key + 5) & 0xff;
+		std::string pattern((const char*)&key, sizeof(key));
+		pattern.append(len, (char)len);
+		auto pos = content.find(pattern);
+		ASSERT_NE(pos, std::string::npos);
+		ASSERT_EQ(fseek(fp, pos, SEEK_SET), 0);
+		ASSERT_EQ(fputc(0x77, fp), 0x77);
+		fclose(fp);
+	}
+
+	auto dict = estuary::Estuary::Load(filename, estuary::Estuary::MONOPOLY, 0, UINT32_MAX);
+	ASSERT_TRUE(!dict);
+	dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	unsigned event = 0;
+	dict.on_corruption([&event](const estuary::Estuary&) { event++; });
+	ASSERT_FALSE(dict.self_test(UINT32_MAX));
+	ASSERT_EQ(event, 1);
+	ASSERT_TRUE(dict.writes_frozen());
+	ASSERT_EQ(dict.quarantine(), 0);
+	ASSERT_TRUE(dict.thaw_writes());
+	dict.on_corruption([&event](const estuary::Estuary&) { event++; }, false);
+	ASSERT_EQ(dict.item(), PIECE);
+	struct : public estuary::Logger {
+		std::string text;
+		void printf(const char* format, va_list args) override {
+			char buf[256];
+			vsnprintf(buf, sizeof(buf), format, args);
+			text += buf;
+		}
+	} logger;
+	auto old_logger = estuary::Logger::Bind(&logger);
+	ASSERT_EQ(dict.quarantine(), 1);
+	estuary::Logger::Bind(old_logger);
+	ASSERT_NE(logger.text.find("with key of 8 bytes (hash "), std::string::npos);
+	ASSERT_FALSE(dict.writes_frozen());
+	ASSERT_EQ(event, 2);
+	ASSERT_TRUE(dict.self_test(UINT32_MAX));
+	ASSERT_EQ(dict.quarantine(), 0);
+	ASSERT_EQ(dict.quarantined(), 1);
+	ASSERT_EQ(dict.item(), PIECE-1);
+
+	std::string val;
+	source.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = source.read();
+		ASSERT_EQ(dict.fetch(rec.key, val), i != 500);
+	}
+}
+
+TEST(Estuary, FreezeWrites) {
+	const std::string filename = "freeze.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_FALSE(dict.writes_frozen());
+	ASSERT_TRUE(dict.freeze_writes());
+	ASSERT_TRUE(dict.writes_frozen());
+	const auto generation = dict.generation();
+
+	std::string val;
+	source.reset();
+	auto rec = source.read();
+	ASSERT_FALSE(dict.update(rec.key, rec.val));
+	ASSERT_FALSE(dict.erase(rec.key));
+	ASSERT_FALSE(dict.add_to_set(rec.key, rec.val));
+	ASSERT_TRUE(dict.fetch(rec.key, val));
+	ASSERT_EQ(dict.item(), PIECE);
+	ASSERT_EQ(dict.generation(), generation);
+
+	ASSERT_TRUE(dict.thaw_writes());
+	ASSERT_FALSE(dict.writes_frozen());
+	ASSERT_TRUE(dict.erase(rec.key));
+	ASSERT_EQ(dict.generation(), generation+2);	//odd during writing
+	ASSERT_FALSE(dict.erase(rec.key));
+	ASSERT_EQ(dict.generation(), generation+4);	//failed write may move data too
+	ASSERT_TRUE(dict.update(rec.key, rec.val));
+	ASSERT_TRUE(dict.update(rec.key, rec.val));
+	ASSERT_EQ(dict.generation(), generation+6);	//same value changes nothing
+	ASSERT_TRUE(dict.erase(rec.key));
+	ASSERT_EQ(dict.item(), PIECE-1);
+}
+
+TEST(Estuary, Audit) {
+	const std::string filename = "audit.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	std::vector<estuary::Estuary::AuditEvent> events;
+	dict.set_audit_sink([&events](const estuary::Estuary::AuditEvent& event) {
+		events.push_back(event);
+	});
+
+	source.reset();
+	auto rec1 = source.read();
+	auto rec2 = source.read();
+	ASSERT_TRUE(dict.update(rec1.key, rec2.val));
+	ASSERT_TRUE(dict.erase(rec1.key));
+	ASSERT_FALSE(dict.erase(rec1.key));
+	ASSERT_TRUE(dict.add_to_set(rec1.key, rec2.val));
+	ASSERT_FALSE(dict.remove_from_set(rec1.key, rec1.val));	//no change, no event
+
+	ASSERT_EQ(events.size(), 4);
+	ASSERT_EQ(events[0].op, estuary::Estuary::AuditEvent::UPDATE);
+	ASSERT_EQ(events[0].size, rec2.val.len);
+	ASSERT_TRUE(events[0].done);
+	ASSERT_EQ(events[1].op, estuary::Estuary::AuditEvent::ERASE);
+	ASSERT_TRUE(events[1].done);
+	ASSERT_EQ(events[2].op, estuary::Estuary::AuditEvent::ERASE);
+	ASSERT_FALSE(events[2].done);
+	ASSERT_EQ(events[3].op, estuary::Estuary::AuditEvent::UPDATE);
+	ASSERT_EQ(events[3].size, rec2.val.len + 2);
+	ASSERT_TRUE(events[3].done);
+	for (auto& event : events) {
+		ASSERT_EQ(event.key_hash, events[0].key_hash);
+		ASSERT_TRUE(event.time <= std::chrono::system_clock::now());
+	}
+}
+
+TEST(Estuary, KeyTransform) {
+	const std::string filename = "transform.es";
+	auto lower = [](estuary::Slice key, std::string& out) {
+		out.assign((const char*)key.ptr, key.len);
+		for (auto& ch : out) {
+			ch = tolower(ch);
+		}
+	};
+
+	auto config = CONFIG;
+	config.key_transform = lower;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	dict.set_key_transform(lower);
+
+	const std::string key1 = "Hello";
+	const std::string key2 = "HELLO";
+	const std::string val = "world";
+	ASSERT_TRUE(dict.update({(const uint8_t*)key1.data(), key1.size()}, {(const uint8_t*)val.data(), val.size()}));
+	std::string out;
+	ASSERT_TRUE(dict.fetch({(const uint8_t*)key2.data(), key2.size()}, out));
+	ASSERT_EQ(out, val);
+	ASSERT_EQ(dict.item(), 1);
+
+	std::vector<estuary::Estuary::Item> items;
+	ASSERT_EQ(dict.scan(0, 10, items), 0);
+	ASSERT_EQ(items.size(), 1);
+	ASSERT_EQ(items[0].key, "hello");
+
+	ASSERT_TRUE(dict.erase({(const uint8_t*)key2.data(), key2.size()}));
+	ASSERT_EQ(dict.item(), 0);
+
+	auto slice = [](const char* str)->estuary::Slice {
+		return {(const uint8_t*)str, strlen(str)};
+	};
+	std::vector<bool> done;
+	ASSERT_EQ(dict.update_batch({{slice("Apple"), slice("1")}, {slice("BANANA"), slice("2")}}, done), 2);
+	std::vector<std::string> vals;
+	std::vector<bool> found;
+	ASSERT_EQ(dict.batch_fetch({slice("APPLE"), slice("banana"), slice("cherry")}, vals, found), 2);
+	ASSERT_EQ(vals[0], "1");
+	ASSERT_EQ(vals[1], "2");
+	ASSERT_FALSE(found[2]);
+	ASSERT_EQ(dict.erase_batch({slice("apple"), slice("Banana")}, done), 2);
+	ASSERT_EQ(dict.item(), 0);
+
+	auto prefix = [](estuary::Slice key, std::string& out) {	//not idempotent
+		out.assign("k:");
+		out.append((const char*)key.ptr, key.len);
+	};
+	dict.set_key_transform(prefix);
+	const estuary::Slice set = {(const uint8_t*)"set", 3};
+	const estuary::Slice member = {(const uint8_t*)"one", 3};
+	ASSERT_TRUE(dict.add_to_set(set, member));
+	std::vector<std::string> members;
+	ASSERT_TRUE(dict.members(set, members));
+	ASSERT_EQ(members.size(), 1);
+	ASSERT_EQ(members[0], "one");
+	ASSERT_TRUE(dict.append(set, {(const uint8_t*)"\x03\x00two", 5}));
+	ASSERT_TRUE(dict.members(set, members));
+	ASSERT_EQ(members.size(), 2);
+	ASSERT_EQ(dict.scan(0, 10, items), 0);
+	ASSERT_EQ(items.size(), 1);
+	ASSERT_EQ(items[0].key, "k:set");
+	ASSERT_TRUE(dict.remove_from_set(set, member));
+	ASSERT_TRUE(dict.remove_from_set(set, {(const uint8_t*)"two", 3}));
+	ASSERT_EQ(dict.item(), 0);
+
+	const std::string exported = "transform.export";
+	ASSERT_TRUE(dict.update(slice("key"), slice("val")));
+	ASSERT_TRUE(dict.export_prefix(slice("k:"), exported));
+	ASSERT_TRUE(dict.erase(slice("key")));
+	ASSERT_EQ(dict.import_from(exported, {}), 1);
+	ASSERT_EQ(dict.scan(0, 10, items), 0);
+	ASSERT_EQ(items.size(), 1);
+	ASSERT_EQ(items[0].key, "k:key");
+	ASSERT_TRUE(dict.fetch(slice("key"), out));
+	ASSERT_EQ(out, "val");
+}
+
+TEST(Estuary, Validator) {
+	const std::string filename = "validator.es";
+	auto even = [](estuary::Slice key, estuary::Slice val)->bool {
+		return val.len % 2 == 0;
+	};
+
+	VariedValueGenerator source(0, PIECE);
+	auto config = CONFIG;
+	config.validator = even;
+	ASSERT_FALSE(estuary::Estuary::Create(filename, config, &source));
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	dict.set_validator(even);
+
+	source.reset();
+	for (unsigned i = 0; i < 10; i++) {
+		auto rec = source.read();
+		ASSERT_EQ(dict.update(rec.key, rec.val), rec.val.len % 2 == 0);
+	}
+	const uint8_t one[1] = {1};
+	auto append = [](const char* operand, size_t len) {
+		return [operand, len](std::string& val, bool exists)->bool {
+			val.append(operand, len);
+			return true;
+		};
+	};
+	ASSERT_FALSE(dict.update_with({one, 1}, append("\1", 1)));
+	ASSERT_TRUE(dict.update_with({one, 1}, append("\2\2", 2)));
+}
+
+class PairReader : public estuary::IDataReader {
+public:
+	explicit PairReader(std::vector<std::pair<std::string,std::string>> pairs) : m_pairs(std::move(pairs)) {}
+	void reset() override { m_idx = 0; }
+	size_t total() override { return m_pairs.size(); }
+	Record read() override {
+		auto& pair = m_pairs[m_idx++];
+		return {{(const uint8_t*)pair.first.data(), pair.first.size()},
+				{(const uint8_t*)pair.second.data(), pair.second.size()}};
+	}
+private:
+	std::vector<std::pair<std::string,std::string>> m_pairs;
+	size_t m_idx = 0;
+};
+
+TEST(Estuary, DuplicatePolicy) {
+	const std::string filename = "duplicate.es";
+	PairReader source({{"a", "1"}, {"b", "2"}, {"a", "3"}});
+	const estuary::Slice key = {(const uint8_t*)"a", 1};
+	std::string val;
+
+	auto config = CONFIG;
+	estuary::Estuary::BuildReport report;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source, &report));
+	ASSERT_EQ(report.item, 2);
+	ASSERT_EQ(report.duplicate, 1);
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_EQ(dict.item(), 2);
+	ASSERT_TRUE(dict.fetch(key, val));
+	ASSERT_EQ(val, "3");
+	dict = estuary::Estuary();
+
+	config.on_duplicate = estuary::Estuary::Config::KEEP_FIRST;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+	dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_EQ(dict.item(), 2);
+	ASSERT_TRUE(dict.fetch(key, val));
+	ASSERT_EQ(val, "1");
+	dict = estuary::Estuary();
+
+	config.on_duplicate = estuary::Estuary::Config::MERGE;
+	config.duplicate_merger = [](estuary::Slice operand, std::string& val, bool exists)->bool {
+		val.append((const char*)operand.ptr, operand.len);
+		return true;
+	};
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+	dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_EQ(dict.item(), 2);
+	ASSERT_TRUE(dict.fetch(key, val));
+	ASSERT_EQ(val, "13");
+	dict = estuary::Estuary();
+
+	config.on_duplicate = estuary::Estuary::Config::REJECT;
+	ASSERT_FALSE(estuary::Estuary::Create(filename, config, &source));
+}
+
+TEST(Estuary, TombstoneLimit) {
+	const std::string filename = "tombstone.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_EQ(dict.tombstone(), 0);
+	dict.set_tombstone_limit(0.01);
+
+	VariedValueGenerator extra(PIECE, PIECE, 29);	//same value size as origin
+	source.reset();
+	size_t max_tombstone = 0;
+	for (unsigned i = 0; i < PIECE/2; i++) {
+		auto rec = source.read();
+		ASSERT_TRUE(dict.erase(rec.key));
+		rec = extra.read();
+		ASSERT_TRUE(dict.update(rec.key, rec.val));
+		max_tombstone = std::max(max_tombstone, dict.tombstone());
+	}
+	ASSERT_TRUE(max_tombstone != 0);
+	ASSERT_TRUE(max_tombstone < PIECE/20);	//over 300 without limit
+	ASSERT_EQ(dict.stats().tombstone, dict.tombstone());
+	ASSERT_EQ(dict.item(), PIECE);
+}
+
+TEST(Estuary, BlockSize) {
+	const std::string filename = "block.es";
+	auto config = CONFIG;
+	config.block_size = 12;
+	ASSERT_FALSE(estuary::Estuary::Create(filename, config));
+	config.block_size = 128;
+	ASSERT_FALSE(estuary::Estuary::Create(filename, config));
+
+	for (unsigned block_size : {16U, 64U}) {
+		config.block_size = block_size;
+		VariedValueGenerator source(0, PIECE/2);
+		estuary::Estuary::BuildReport report;
+		ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source, &report));
+		ASSERT_EQ(report.data_used % block_size, 0);
+		std::string metadata;
+		ASSERT_TRUE(estuary::Estuary::ReadMetadata(filename, metadata));
+
+		auto dict = estuary::Estuary::Load(filename);
+		ASSERT_FALSE(!dict);
+		for (unsigned round = 1; round <= 4; round++) {	//values change length, relocation is involved
+			VariedValueGenerator more(PIECE/2, PIECE/4, round*8);
+			for (unsigned i = 0; i < PIECE/4; i++) {
+				auto rec = more.read();
+				ASSERT_TRUE(dict.update(rec.key, rec.val));
+			}
+		}
+		source.reset();
+		for (unsigned i = 0; i < PIECE/4; i++) {
+			ASSERT_TRUE(dict.erase(source.read().key));
+		}
+		ASSERT_EQ(dict.item(), PIECE/2);
+		std::string val;
+		VariedValueGenerator more(PIECE/2, PIECE/4, 4*8);
+		for (unsigned i = 0; i < PIECE/4; i++) {
+			auto rec = more.read();
+			ASSERT_TRUE(dict.fetch(rec.key, val));
+			ASSERT_EQ(val.size(), rec.val.len);
+			ASSERT_EQ(memcmp(val.data(), rec.val.ptr, val.size()), 0);
+		}
+		ASSERT_TRUE(dict.self_test(PIECE*2));
+	}
+}
+
+TEST(Estuary, ReserveFactor) {
+	const std::string filename = "reserve.es";
+	auto file_size = [&filename]()->size_t {
+		struct stat info;
+		return stat(filename.c_str(), &info) == 0? info.st_size : 0;
+	};
+	auto config = CONFIG;
+	config.data_reserve_factor = 1;
+	ASSERT_FALSE(estuary::Estuary::Create(filename, config));
+	config.data_reserve_factor = 256;
+	ASSERT_FALSE(estuary::Estuary::Create(filename, config));
+	config.data_reserve_factor = 10;
+	config.entry_reserve_factor = 3;
+	ASSERT_FALSE(estuary::Estuary::Create(filename, config));
+
+	VariedValueGenerator source(0, PIECE/2);
+	estuary::Estuary::BuildReport report;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source, &report));
+	const auto default_size = file_size();
+	const auto default_free = report.data_free;
+
+	config.data_reserve_factor = 50;
+	config.entry_reserve_factor = 4;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source, &report));
+	ASSERT_TRUE(file_size() < default_size);
+	ASSERT_TRUE(report.data_free >= default_free);
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_EQ(dict.data_free(), report.data_free);
+	VariedValueGenerator more(PIECE/2, PIECE/4);
+	for (unsigned i = 0; i < PIECE/4; i++) {
+		auto rec = more.read();
+		ASSERT_TRUE(dict.update(rec.key, rec.val));
+	}
+	source.reset();
+	for (unsigned i = 0; i < PIECE/2; i++) {	//churn to trigger sweeping
+		auto rec = source.read();
+		ASSERT_TRUE(dict.erase(rec.key));
+		ASSERT_TRUE(dict.update(rec.key, rec.val));
+	}
+	ASSERT_EQ(dict.item(), PIECE/2 + PIECE/4);
+	ASSERT_TRUE(dict.self_test(PIECE*2));
+}
+
+TEST(Estuary, WyHash) {
+	const std::string filename = "wyhash.es";
+	auto config = CONFIG;
+	config.hash_func = estuary::Estuary::Config::WYHASH;
+	VariedValueGenerator source(0, PIECE/2);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	std::string val;
+	source.reset();
+	for (unsigned i = 0; i < PIECE/2; i++) {
+		auto rec = source.read();
+		ASSERT_TRUE(dict.fetch(rec.key, val));
+		ASSERT_EQ(val.size(), rec.val.len);
+		ASSERT_EQ(memcmp(val.data(), rec.val.ptr, val.size()), 0);
+	}
+	VariedValueGenerator more(PIECE/2, PIECE/4);
+	for (unsigned i = 0; i < PIECE/4; i++) {
+		auto rec = more.read();
+		ASSERT_TRUE(dict.update_hashed(dict.hash(rec.key), rec.key, rec.val));
+	}
+	ASSERT_EQ(dict.item(), PIECE/2 + PIECE/4);
+	ASSERT_TRUE(dict.self_test(PIECE*2));
+}
+
+TEST(Estuary, SelfTestWithWriter) {
+	const std::string filename = "self-test.es";
+	VariedValueGenerator source(0, PIECE/2);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	unsigned corrupted = 0;
+	dict.on_corruption([&corrupted](const estuary::Estuary&) { corrupted++; });
+	ASSERT_TRUE(dict.self_test(PIECE/2));	//all of a fresh one
+
+	std::atomic<bool> quit(false);
+	std::thread writer([&dict, &quit]() {	//churn to keep sweeping and relocation going
+		VariedValueGenerator temp(PIECE, PIECE/4);
+		for (unsigned round = 0; !quit; round++) {
+			temp.reset();
+			for (unsigned i = 0; i < PIECE/4; i++) {
+				auto rec = temp.read();
+				if (round % 2 == 0) {
+					dict.update(rec.key, rec.val);
+				} else {
+					dict.erase(rec.key);
+				}
+			}
+		}
+	});
+	unsigned failed = 0;
+	for (unsigned i = 0; i < 200; i++) {
+		failed += !dict.self_test(PIECE/8);
+	}
+	quit = true;
+	writer.join();
+	ASSERT_EQ(failed, 0);
+	ASSERT_EQ(corrupted, 0);
+	ASSERT_FALSE(dict.writes_frozen());
+}
+
+TEST(Estuary, Limits) {
+	const std::string filename = "limits.es";
+	const auto limits = estuary::Estuary::GetLimits();
+	ASSERT_EQ(limits.max_key_len, estuary::Estuary::MAX_KEY_LEN);
+	ASSERT_EQ(limits.max_val_len, estuary::Estuary::MAX_VAL_LEN);
+	ASSERT_EQ(limits.block_size, 8);
+	ASSERT_EQ(limits.max_block_size, 64);
+	ASSERT_TRUE(limits.min_item_limit < limits.max_item_limit);
+
+	auto config = CONFIG;
+	config.item_limit = limits.min_item_limit;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config));
+	config.item_limit = limits.min_item_limit - 1;
+	ASSERT_FALSE(estuary::Estuary::Create(filename, config));
+	config.item_limit = limits.max_item_limit + 1;
+	ASSERT_FALSE(estuary::Estuary::Create(filename, config));
+}
+
+//written by the version without extended header: keys 0-149 (uint64) with values "value-N",
+//every third of them erased
+TEST(Estuary, OldFormat) {
+	const std::string filename = "old.es";
+	{
+		std::ifstream src(TEST_DATA_DIR "/v1.es", std::ios::binary);
+		ASSERT_TRUE(src.good());
+		std::ofstream dst(filename, std::ios::binary | std::ios::trunc);
+		dst << src.rdbuf();
+	}
+	std::string metadata = "-";
+	ASSERT_TRUE(estuary::Estuary::ReadMetadata(filename, metadata));
+	ASSERT_TRUE(metadata.empty());
+	ASSERT_TRUE(estuary::Estuary::ResetLocks(filename));
+
+	for (auto policy : {estuary::Estuary::COPY_DATA, estuary::Estuary::SHARED, estuary::Estuary::MONOPOLY}) {
+		auto dict = estuary::Estuary::Load(filename, policy, 0, 100);
+		ASSERT_FALSE(!dict);
+		ASSERT_EQ(dict.item(), 100U);
+		std::string val;
+		for (uint64_t i = 0; i < 150; i++) {
+			const estuary::Slice key = {(const uint8_t*)&i, sizeof(i)};
+			if (i % 3 == 0) {
+				ASSERT_FALSE(dict.fetch(key, val));
+			} else {
+				ASSERT_TRUE(dict.fetch(key, val));
+				ASSERT_EQ(val, "value-" + std::to_string(i));
+			}
+		}
+		estuary::Estuary::RecordMeta meta;
+		ASSERT_TRUE(dict.fetch_with_meta({(const uint8_t*)"\1\0\0\0\0\0\0\0", 8}, val, meta));
+		ASSERT_EQ(meta.mtime.time_since_epoch().count(), 0);
+		ASSERT_EQ(dict.generation(), 0U);
+		ASSERT_TRUE(dict.self_test(100));
+	}
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	const uint64_t key = 1000;
+	const std::string value = "new";
+	ASSERT_TRUE(dict.update({(const uint8_t*)&key, sizeof(key)}, {(const uint8_t*)value.data(), value.size()}));
+	ASSERT_EQ(dict.generation(), 2U);
+	ASSERT_TRUE(dict.erase({(const uint8_t*)"\2\0\0\0\0\0\0\0", 8}));
+	ASSERT_EQ(dict.item(), 100U);
+	ASSERT_TRUE(dict.dump("old-dump.es"));
+	ASSERT_TRUE(dict.rebuild("old-rebuild.es"));
+	dict = estuary::Estuary();
+
+	for (auto& name : {"old-dump.es", "old-rebuild.es"}) {
+		dict = estuary::Estuary::Load(name);
+		ASSERT_FALSE(!dict);
+		std::string val;
+		ASSERT_TRUE(dict.fetch({(const uint8_t*)&key, sizeof(key)}, val));
+		ASSERT_EQ(val, value);
+		ASSERT_FALSE(dict.fetch({(const uint8_t*)"\2\0\0\0\0\0\0\0", 8}, val));
+		ASSERT_TRUE(dict.fetch({(const uint8_t*)"\4\0\0\0\0\0\0\0", 8}, val));
+		ASSERT_EQ(val, "value-4");
+		ASSERT_TRUE(dict.self_test(100));
+	}
+}
+
+TEST(Estuary, Metadata) {
+	const std::string filename = "metadata.es";
+	const std::string metadata = R"({"creator":"test","version":3})";
+
+	VariedValueGenerator source(0, PIECE);
+	auto config = CONFIG;
+	config.metadata = metadata;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	std::string out;
+	ASSERT_TRUE(estuary::Estuary::ReadMetadata(filename, out));
+	ASSERT_EQ(out, metadata);
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_EQ(dict.metadata(), metadata);
+	ASSERT_EQ(dict.item(), PIECE);
+
+	ASSERT_TRUE(dict.dump(filename+".bak"));
+	ASSERT_TRUE(estuary::Estuary::ReadMetadata(filename+".bak", out));
+	ASSERT_EQ(out, metadata);
+
+	dict = estuary::Estuary();
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG));
+	ASSERT_TRUE(estuary::Estuary::ReadMetadata(filename, out));
+	ASSERT_TRUE(out.empty());
+}
+
+TEST(Estuary, Hashed) {
+	const std::string filename = "hashed.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	std::string val;
+	source.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = source.read();
+		const auto code = dict.hash(rec.key);
+		ASSERT_TRUE(dict.fetch_hashed(code, rec.key, val));
+		ASSERT_EQ(val.size(), rec.val.len);
+		if (i % 2 == 0) {
+			ASSERT_TRUE(dict.erase_hashed(code, rec.key));
+		} else {
+			ASSERT_TRUE(dict.update_hashed(code, rec.key, rec.key));
+		}
+	}
+	source.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = source.read();
+		ASSERT_EQ(dict.fetch(rec.key, val), i % 2 != 0);
+		if (i % 2 != 0) {
+			ASSERT_EQ(val.size(), rec.key.len);
+		}
+	}
+}
+
+TEST(Estuary, Ingest) {
+	const std::string filename = "ingest.es";
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	VariedValueGenerator source(0, PIECE);
+	estuary::Estuary::IngestOptions options;
+	options.batch = 100;
+	unsigned calls = 0;
+	options.progress = [&calls](size_t done, size_t total) {
+		calls++;
+		ASSERT_EQ(done, calls*100);
+		ASSERT_EQ(total, PIECE);
+	};
+	ASSERT_EQ(dict.ingest(source, options), PIECE);
+	ASSERT_EQ(calls, PIECE/100);
+	ASSERT_EQ(dict.item(), PIECE);
+
+	std::string val;
+	source.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = source.read();
+		ASSERT_TRUE(dict.fetch(rec.key, val));
+		ASSERT_EQ(val.size(), rec.val.len);
+	}
+
+	VariedValueGenerator more(PIECE, PIECE);
+	options.progress = nullptr;
+	const auto cnt = dict.ingest(more, options);
+	ASSERT_TRUE(cnt < PIECE);
+	ASSERT_EQ(dict.item(), PIECE + cnt);
+	options.stop_on_failure = false;
+	ASSERT_TRUE(dict.ingest(more, options) <= cnt);
+	ASSERT_EQ(dict.item(), PIECE + cnt);
+}
+
+TEST(Estuary, Seal) {
+	const std::string filename = "seal.es";
+
+	VariedValueGenerator source(0, PIECE);
+	auto config = CONFIG;
+	config.record_stamp = true;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	auto dict = estuary::Estuary::Load(filename, estuary::Estuary::SHARED);
+	ASSERT_FALSE(!dict);
+	ASSERT_FALSE(dict.seal());
+	dict = estuary::Estuary();
+	dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_TRUE(dict.seal());
+	ASSERT_TRUE(dict.writes_frozen());
+
+	std::string val;
+	estuary::Estuary::RecordMeta meta;
+	source.reset();
+	auto rec = source.read();
+	ASSERT_FALSE(dict.update(rec.key, rec.val));
+	ASSERT_FALSE(dict.erase(rec.key));
+	ASSERT_TRUE(dict.fetch_with_meta(rec.key, val, meta));
+	ASSERT_EQ(dict.fetch_if_modified_since(rec.key, meta.mtime, val), estuary::Estuary::NOT_MODIFIED);
+	for (unsigned i = 1; i < PIECE; i++) {
+		rec = source.read();
+		ASSERT_TRUE(dict.fetch(rec.key, val));
+		ASSERT_EQ(val.size(), rec.val.len);
+		ASSERT_EQ(memcmp(val.data(), rec.val.ptr, rec.val.len), 0);
+	}
+	const uint64_t missing = PIECE*2;
+	ASSERT_FALSE(dict.fetch({(const uint8_t*)&missing, sizeof(missing)}, val));
+
+	ASSERT_TRUE(dict.unseal());
+	ASSERT_FALSE(dict.writes_frozen());
+	source.reset();
+	rec = source.read();
+	ASSERT_TRUE(dict.erase(rec.key));
+	ASSERT_FALSE(dict.fetch(rec.key, val));
+	ASSERT_TRUE(dict.seal());
+	ASSERT_FALSE(dict.fetch(rec.key, val));
+	ASSERT_TRUE(dict.unseal());
+	ASSERT_TRUE(dict.update(rec.key, rec.val));
+
+	dict = estuary::Estuary();
+	dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_FALSE(dict.writes_frozen());
+}
+
+TEST(Estuary, SealWithLoadFactor) {
+	const std::string filename = "seal-sparse.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_FALSE(dict.seal(1));
+	ASSERT_FALSE(dict.seal(-0.5));
+	ASSERT_FALSE(dict.writes_frozen());
+
+	std::string val;
+	for (unsigned round = 0; round < 2; round++) {
+		ASSERT_TRUE(dict.seal(0.25));
+		source.reset();
+		for (unsigned i = 0; i < PIECE; i++) {
+			auto rec = source.read();
+			if (i < round) {
+				ASSERT_FALSE(dict.fetch(rec.key, val));
+				continue;
+			}
+			ASSERT_TRUE(dict.fetch(rec.key, val));
+			ASSERT_EQ(val.size(), rec.val.len);
+			ASSERT_EQ(memcmp(val.data(), rec.val.ptr, rec.val.len), 0);
+		}
+		const uint64_t missing = PIECE*2;
+		ASSERT_FALSE(dict.fetch({(const uint8_t*)&missing, sizeof(missing)}, val));
+
+		ASSERT_TRUE(dict.unseal());
+		const uint64_t next = round;
+		ASSERT_TRUE(dict.erase({(const uint8_t*)&next, sizeof(next)}));
+	}
+	ASSERT_EQ(dict.item(), PIECE-2);
+}
+
+TEST(Estuary, BatchFetch) {
+	const std::string filename = "batch.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	std::vector<uint64_t> ids;
+	for (uint64_t i = 0; i < 64; i++) {
+		ids.push_back(i * 31);	//half of them are missing
+	}
+	std::vector<estuary::Slice> keys;
+	for (auto& id : ids) {
+		keys.push_back({(const uint8_t*)&id, sizeof(id)});
+	}
+	keys.push_back({});
+	std::vector<std::string> vals;
+	std::vector<bool> found;
+	ASSERT_EQ(dict.batch_fetch(keys, vals, found), (PIECE+30)/31);
+	ASSERT_EQ(vals.size(), keys.size());
+	ASSERT_EQ(found.size(), keys.size());
+	for (size_t i = 0; i < ids.size(); i++) {
+		ASSERT_EQ(found[i], ids[i] < PIECE);
+		if (found[i]) {
+			const uint8_t len = ids[i] + 5;
+			ASSERT_EQ(vals[i], std::string(len, (char)len));
+		}
+	}
+	ASSERT_FALSE(found.back());
+}
+
+TEST(Estuary, UpdateInPlace) {
+	const std::string filename = "in-place.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	const auto free = dict.data_free();
+	std::string val;
+	for (unsigned round = 1; round <= 20; round++) {
+		source.reset();
+		for (unsigned i = 0; i < PIECE; i++) {
+			auto rec = source.read();
+			std::string tmp((const char*)rec.val.ptr, rec.val.len);
+			if (!tmp.empty()) {
+				tmp[0] = (char)round;
+			}
+			ASSERT_TRUE(dict.update(rec.key, {(const uint8_t*)tmp.data(), tmp.size()}));
+		}
+		ASSERT_EQ(dict.data_free(), free);
+	}
+	ASSERT_EQ(dict.tombstone(), 0);
+
+	source.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = source.read();
+		ASSERT_TRUE(dict.fetch(rec.key, val));
+		ASSERT_EQ(val.size(), rec.val.len);
+		if (!val.empty()) {
+			ASSERT_EQ(val[0], (char)20);
+			ASSERT_EQ(memcmp(val.data()+1, rec.val.ptr+1, rec.val.len-1), 0);
+		}
+	}
+}
+
+TEST(Estuary, WriteBatch) {
+	const std::string filename = "write-batch.es";
+
+	VariedValueGenerator source(0, PIECE/2);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	unsigned audited = 0;
+	dict.set_audit_sink([&audited](const estuary::Estuary::AuditEvent&) { audited++; });
+
+	std::vector<uint64_t> ids(100);
+	std::vector<estuary::IDataReader::Record> items;
+	for (unsigned i = 0; i < ids.size(); i++) {
+		ids[i] = PIECE/2 + i;
+		items.push_back({{(const uint8_t*)&ids[i], sizeof(uint64_t)}, {(const uint8_t*)"value", 5}});
+	}
+	items.push_back({});	//invalid one
+	std::vector<bool> done;
+	ASSERT_EQ(dict.update_batch(items, done), 100);
+	ASSERT_EQ(done.size(), items.size());
+	ASSERT_FALSE(done.back());
+	ASSERT_EQ(dict.item(), PIECE/2 + 100);
+	ASSERT_EQ(audited, 100);
+
+	std::string val;
+	for (unsigned i = 0; i < 100; i++) {
+		ASSERT_TRUE(done[i]);
+		ASSERT_TRUE(dict.fetch(items[i].key, val));
+		ASSERT_EQ(val, "value");
+	}
+
+	std::vector<uint64_t> missing(50);
+	std::vector<estuary::Slice> keys;
+	for (unsigned i = 0; i < 50; i++) {
+		keys.push_back(items[i*2].key);
+	}
+	for (unsigned i = 0; i < 50; i++) {
+		missing[i] = PIECE*2 + i;
+		keys.push_back({(const uint8_t*)&missing[i], sizeof(uint64_t)});
+	}
+	ASSERT_EQ(dict.erase_batch(keys, done), 50);
+	for (unsigned i = 0; i < 100; i++) {
+		ASSERT_EQ(done[i], i < 50);
+	}
+	ASSERT_EQ(dict.item(), PIECE/2 + 50);
+
+	dict.freeze_writes();
+	ASSERT_EQ(dict.erase_batch(keys, done), 0);
+	ASSERT_EQ(dict.update_batch(items, done), 0);
+}
+
+TEST(Estuary, GetSet) {
+	const std::string filename = "get-set.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	source.reset();
+	auto rec = source.read();
+	std::string old, val;
+	bool existed = false;
+	ASSERT_TRUE(dict.get_set(rec.key, {(const uint8_t*)"abc", 3}, old, existed));
+	ASSERT_TRUE(existed);
+	ASSERT_EQ(old, std::string((const char*)rec.val.ptr, rec.val.len));
+	ASSERT_TRUE(dict.fetch(rec.key, val));
+	ASSERT_EQ(val, "abc");
+
+	ASSERT_TRUE(dict.get_set(rec.key, {(const uint8_t*)"xyz", 3}, old, existed));
+	ASSERT_TRUE(existed);
+	ASSERT_EQ(old, "abc");
+
+	const uint64_t key = PIECE;
+	ASSERT_TRUE(dict.get_set({(const uint8_t*)&key, sizeof(key)}, {(const uint8_t*)"new", 3}, old, existed));
+	ASSERT_FALSE(existed);
+	ASSERT_TRUE(old.empty());
+	ASSERT_TRUE(dict.fetch({(const uint8_t*)&key, sizeof(key)}, val));
+	ASSERT_EQ(val, "new");
+}
+
+TEST(Estuary, UpdateWith) {
+	const std::string filename = "update-with.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	auto append = [](std::string& val, bool exists)->bool {
+		if (!exists) {
+			val = "head";
+		}
+		val.push_back('+');
+		return true;
+	};
+	const uint64_t key = PIECE;
+	const estuary::Slice k = {(const uint8_t*)&key, sizeof(key)};
+	std::string val;
+	ASSERT_TRUE(dict.update_with(k, append));
+	ASSERT_TRUE(dict.update_with(k, append));
+	ASSERT_TRUE(dict.fetch(k, val));
+	ASSERT_EQ(val, "head++");
+
+	ASSERT_FALSE(dict.update_with(k, [](std::string& val, bool)->bool {
+		val = "dropped";
+		return false;
+	}));
+	ASSERT_TRUE(dict.fetch(k, val));
+	ASSERT_EQ(val, "head++");
+
+	ASSERT_FALSE(dict.update_with(k, [](std::string& val, bool)->bool {
+		val.assign(UINT8_MAX+1, 'x');
+		return true;
+	}));
+	ASSERT_EQ(dict.item(), PIECE + 1);
+}
+
+TEST(Estuary, Clock) {
+	struct FakeClock : public estuary::Clock {
+		uint64_t time = 1000000;
+		uint64_t now() override { return time; }
+		uint64_t seed() override { return 123; }
+	} clock;
+	ClockBinding binding(&clock);
+
+	const std::string filename1 = "clock1.es";
+	const std::string filename2 = "clock2.es";
+	auto config = CONFIG;
+	config.record_stamp = true;
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename1, config, &source));
+	ASSERT_TRUE(estuary::Estuary::Create(filename2, config, &source));
+	auto dict1 = estuary::Estuary::Load(filename1);
+	auto dict2 = estuary::Estuary::Load(filename2);
+	ASSERT_FALSE(!dict1);
+	ASSERT_FALSE(!dict2);
+
+	const uint64_t key = 1;
+	const estuary::Slice k = {(const uint8_t*)&key, sizeof(key)};
+	ASSERT_EQ(dict1.hash(k), dict2.hash(k));
+
+	std::string val;
+	estuary::Estuary::RecordMeta meta;
+	ASSERT_TRUE(dict1.fetch_with_meta(k, val, meta));
+	ASSERT_EQ(meta.mtime.time_since_epoch(), std::chrono::microseconds(1000000));
+	clock.time = 2000000;
+	ASSERT_TRUE(dict1.update(k, {(const uint8_t*)"abc", 3}));
+	ASSERT_TRUE(dict1.fetch_with_meta(k, val, meta));
+	ASSERT_EQ(meta.mtime.time_since_epoch(), std::chrono::microseconds(2000000));
+}
+
+TEST(Estuary, FetchView) {
+	const std::string filename = "view.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	source.reset();
+	auto rec = source.read();
+	estuary::Estuary::View view;
+	ASSERT_TRUE(dict.fetch_view(rec.key, view));
+	ASSERT_EQ(view.val.len, rec.val.len);
+	ASSERT_EQ(memcmp(view.val.ptr, rec.val.ptr, rec.val.len), 0);
+	ASSERT_TRUE(dict.view_valid(view));
+
+	const uint64_t missing = PIECE;
+	ASSERT_FALSE(dict.fetch_view({(const uint8_t*)&missing, sizeof(missing)}, view));
+	ASSERT_FALSE(dict.view_valid(view));
+
+	rec = source.read();
+	ASSERT_TRUE(dict.fetch_view(rec.key, view));
+	ASSERT_TRUE(dict.update(rec.key, {(const uint8_t*)"abc", 3}));
+	ASSERT_FALSE(dict.view_valid(view));
+	ASSERT_TRUE(dict.fetch_view(rec.key, view));
+	ASSERT_FALSE(dict.erase({(const uint8_t*)&missing, sizeof(missing)}));
+	ASSERT_FALSE(dict.view_valid(view));
+
+	//a valid view never shows a torn value, whose bytes are all the same
+	VariedValueGenerator other(PIECE/2, 1);
+	const auto hot = other.read();
+	std::atomic<bool> quit(false);
+	std::thread writer([&dict, &hot, &quit]() {
+		uint8_t buf[UINT8_MAX];
+		for (unsigned i = 0; !quit; i++) {
+			const uint8_t len = i % 200 + 1;
+			memset(buf, len, len);
+			dict.update(hot.key, {buf, len});
+		}
+	});
+	unsigned valid = 0;
+	for (unsigned i = 0; i < 100000 || (valid == 0 && i < 100000000); i++) {
+		if (!dict.fetch_view(hot.key, view)) {
+			continue;
+		}
+		std::string copy((const char*)view.val.ptr, view.val.len);
+		if (dict.view_valid(view)) {
+			valid++;
+			ASSERT_EQ(copy, std::string(copy.size(), (char)copy.size()));
+		}
+	}
+	quit = true;
+	writer.join();
+	ASSERT_NE(valid, 0);
+
+	ASSERT_TRUE(dict.seal());
+	ASSERT_TRUE(dict.fetch_view(rec.key, view));
+	ASSERT_EQ(std::string((const char*)view.val.ptr, view.val.len), "abc");
+	ASSERT_TRUE(dict.view_valid(view));
+}
+
+TEST(Estuary, Add) {
+	const std::string filename = "add.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	const uint64_t key = PIECE;
+	const estuary::Slice k = {(const uint8_t*)&key, sizeof(key)};
+	int64_t result = 0;
+	ASSERT_TRUE(dict.add(k, 5, result));
+	ASSERT_EQ(result, 5);
+	ASSERT_TRUE(dict.add(k, -8, result));
+	ASSERT_EQ(result, -3);
+	const auto free = dict.data_free();
+	for (int i = 0; i < 100; i++) {
+		ASSERT_TRUE(dict.add(k, 1, result));
+	}
+	ASSERT_EQ(result, 97);
+	ASSERT_EQ(dict.data_free(), free);
+
+	std::string val;
+	ASSERT_TRUE(dict.fetch(k, val));
+	ASSERT_EQ(val.size(), sizeof(int64_t));
+	int64_t num;
+	memcpy(&num, val.data(), sizeof(num));
+	ASSERT_EQ(num, 97);
+
+	source.reset();
+	auto rec = source.read();	//5 bytes
+	ASSERT_FALSE(dict.add(rec.key, 1, result));
+	ASSERT_EQ(result, 97);
+}
+
+TEST(Estuary, Append) {
+	const std::string filename = "append.es";
+
+	VariedValueGenerator source(0, PIECE/2);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	const uint64_t key = PIECE;
+	const estuary::Slice k = {(const uint8_t*)&key, sizeof(key)};
+	std::string val;
+	ASSERT_TRUE(dict.append(k, {(const uint8_t*)"ab", 2}));
+	ASSERT_TRUE(dict.append(k, {(const uint8_t*)"cd", 2}));
+	ASSERT_TRUE(dict.fetch(k, val));
+	ASSERT_EQ(val, "abcd");
+
+	std::string tail(CONFIG.max_val_len - 4, 'x');
+	ASSERT_TRUE(dict.append(k, {(const uint8_t*)tail.data(), tail.size()}));
+	ASSERT_FALSE(dict.append(k, {(const uint8_t*)"!", 1}));
+	ASSERT_TRUE(dict.fetch(k, val));
+	ASSERT_EQ(val, "abcd" + tail);
+}
+
+TEST(Estuary, PatchValue) {
+	const std::string filename = "patch.es";
+
+	VariedValueGenerator source(0, PIECE/2);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	const uint64_t key = PIECE;
+	const estuary::Slice k = {(const uint8_t*)&key, sizeof(key)};
+	ASSERT_FALSE(dict.patch_value(k, 0, {(const uint8_t*)"x", 1}));
+	ASSERT_TRUE(dict.update(k, {(const uint8_t*)"abcdef", 6}));
+	const auto item = dict.item();
+	ASSERT_TRUE(dict.patch_value(k, 2, {(const uint8_t*)"XY", 2}));
+	ASSERT_TRUE(dict.patch_value(k, 5, {(const uint8_t*)"Z", 1}));
+	ASSERT_FALSE(dict.patch_value(k, 5, {(const uint8_t*)"ZZ", 2}));
+	ASSERT_FALSE(dict.patch_value(k, SIZE_MAX, {(const uint8_t*)"Z", 1}));
+	std::string val;
+	ASSERT_TRUE(dict.fetch(k, val));
+	ASSERT_EQ(val, "abXYeZ");
+	ASSERT_EQ(dict.item(), item);
+
+	dict.set_validator([](estuary::Slice, estuary::Slice val)->bool {
+		return val.len == 0 || val.ptr[0] != '!';
+	});
+	ASSERT_FALSE(dict.patch_value(k, 0, {(const uint8_t*)"!", 1}));
+	ASSERT_TRUE(dict.fetch(k, val));
+	ASSERT_EQ(val, "abXYeZ");
+}
+
+TEST(Estuary, FetchRange) {
+	const std::string filename = "range.es";
+
+	VariedValueGenerator source(0, PIECE/2);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	const uint64_t key = PIECE;
+	const estuary::Slice k = {(const uint8_t*)&key, sizeof(key)};
+	std::string val;
+	ASSERT_FALSE(dict.fetch_range(k, 0, 1, val));
+	ASSERT_TRUE(dict.update(k, {(const uint8_t*)"0123456789", 10}));
+	ASSERT_TRUE(dict.fetch_range(k, 2, 3, val));
+	ASSERT_EQ(val, "234");
+	ASSERT_TRUE(dict.fetch_range(k, 8, 100, val));
+	ASSERT_EQ(val, "89");
+	ASSERT_TRUE(dict.fetch_range(k, 20, 1, val));
+	ASSERT_TRUE(val.empty());
+	ASSERT_TRUE(dict.fetch_range(k, 0, SIZE_MAX, val));
+	ASSERT_EQ(val, "0123456789");
+
+	//buffer is allocated only for the piece
+	const std::string content(CONFIG.max_val_len, 'x');
+	val = std::string();
+	ASSERT_TRUE(dict.update(k, {(const uint8_t*)content.data(), content.size()}));
+	ASSERT_TRUE(dict.fetch_range(k, 1, 2, val));
+	ASSERT_EQ(val, "xx");
+	ASSERT_TRUE(val.capacity() < content.size());
+
+	ASSERT_TRUE(dict.seal());
+	ASSERT_TRUE(dict.fetch_range(k, content.size()-1, 8, val));
+	ASSERT_EQ(val, "x");
+}
+
+TEST(Estuary, Progress) {
+	const std::string filename = "progress.es";
+
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	size_t calls = 0, last = 0, size = 0;
+	auto progress = [&](size_t done, size_t total) {
+		calls++;
+		ASSERT_TRUE(done >= last && done <= total);
+		last = done;
+		size = total;
+	};
+	ASSERT_TRUE(dict.dump(filename+".bak", progress));
+	ASSERT_NE(calls, 0);
+	ASSERT_NE(size, 0);
+	ASSERT_EQ(last, size);
+	ASSERT_TRUE(dict.dump(filename+".bak", nullptr, true));
+
+	const auto dumped = size;
+	calls = last = size = 0;
+	auto copy = estuary::Estuary::Load(filename+".bak", estuary::Estuary::COPY_DATA, 0, 0, progress);
+	ASSERT_FALSE(!copy);
+	ASSERT_NE(calls, 0);
+	ASSERT_EQ(size, dumped);
+	ASSERT_EQ(last, size);
+	ASSERT_EQ(copy.item(), PIECE);
+}
+
+TEST(Estuary, TTL) {
+	struct FakeClock : public estuary::Clock {
+		uint64_t time = 1000000;
+		uint64_t now() override { return time; }
+		uint64_t seed() override { return 1; }
+	} clock;
+	ClockBinding binding(&clock);
+
+	const std::string filename = "ttl.es";
+	auto config = CONFIG;
+	config.record_stamp = true;
+	config.record_ttl = true;
+	VariedValueGenerator source(0, PIECE/2);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	uint64_t ids[4] = {PIECE, PIECE+1, PIECE+2, PIECE+3};
+	estuary::Slice keys[4];
+	for (unsigned i = 0; i < 4; i++) {
+		keys[i] = {(const uint8_t*)&ids[i], sizeof(uint64_t)};
+	}
+	const std::chrono::microseconds ttl(10);
+	const int64_t zero = 0;
+	ASSERT_TRUE(dict.update_ttl(keys[0], {(const uint8_t*)"a", 1}, ttl));
+	ASSERT_TRUE(dict.update_ttl(keys[1], {(const uint8_t*)"b", 1}, ttl));
+	ASSERT_TRUE(dict.update_ttl(keys[2], {(const uint8_t*)&zero, sizeof(zero)}, ttl));
+	ASSERT_TRUE(dict.update_ttl(keys[3], {(const uint8_t*)"d", 1}, ttl));
+	ASSERT_TRUE(dict.update(keys[1], {(const uint8_t*)"bb", 2}));	//clear ttl
+	int64_t num = 0;
+	ASSERT_TRUE(dict.add(keys[2], 1, num));		//keep ttl
+
+	std::string val;
+	estuary::Estuary::RecordMeta meta;
+	ASSERT_TRUE(dict.fetch_with_meta(keys[0], val, meta));
+	ASSERT_EQ(val, "a");
+	ASSERT_EQ(meta.mtime.time_since_epoch(), std::chrono::microseconds(1000000));
+	ASSERT_EQ(dict.item(), PIECE/2 + 4);
+
+	clock.time += ttl.count();
+	ASSERT_FALSE(dict.fetch(keys[0], val));
+	estuary::Estuary::View view;
+	ASSERT_FALSE(dict.fetch_view(keys[0], view));
+	ASSERT_TRUE(dict.fetch(keys[1], val));
+	ASSERT_EQ(val, "bb");
+	ASSERT_FALSE(dict.fetch(keys[2], val));
+	ASSERT_EQ(dict.count([](estuary::Slice)->bool { return true; }), PIECE/2 + 1);
+	ASSERT_FALSE(dict.erase(keys[3]));
+	ASSERT_EQ(dict.item(), PIECE/2 + 3);
+
+	ASSERT_TRUE(dict.add(keys[2], 5, num));		//expired one is missing
+	ASSERT_EQ(num, 5);
+	clock.time += ttl.count();
+	ASSERT_TRUE(dict.fetch(keys[2], val));
+
+	dict = estuary::Estuary();
+	std::remove(filename.c_str());
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+	dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_FALSE(dict.update_ttl(keys[0], {(const uint8_t*)"a", 1}, ttl));
+}
+
+TEST(Estuary, Touch) {
+	struct FakeClock : public estuary::Clock {
+		uint64_t time = 1000000;
+		uint64_t now() override { return time; }
+		uint64_t seed() override { return 2; }
+	} clock;
+	ClockBinding binding(&clock);
+
+	const std::string filename = "touch.es";
+	auto config = CONFIG;
+	config.record_stamp = true;
+	config.record_ttl = true;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	uint64_t ids[2] = {1, 2};
+	const estuary::Slice keys[2] = {
+		{(const uint8_t*)&ids[0], sizeof(uint64_t)},
+		{(const uint8_t*)&ids[1], sizeof(uint64_t)},
+	};
+	const std::chrono::microseconds ttl(10);
+	ASSERT_TRUE(dict.update_ttl(keys[0], {(const uint8_t*)"a", 1}, ttl));
+	ASSERT_TRUE(dict.update_ttl(keys[1], {(const uint8_t*)"b", 1}, ttl));
+	ASSERT_FALSE(dict.touch({(const uint8_t*)"none", 4}, ttl));
+
+	dict.enable_stats();
+	size_t audited = 0;
+	dict.set_audit_sink([&audited](const estuary::Estuary::AuditEvent& event) {
+		audited += event.done;
+	});
+	const auto generation = dict.generation();
+	clock.time += ttl.count() - 1;
+	ASSERT_TRUE(dict.touch(keys[0], ttl));
+	ASSERT_TRUE(dict.touch(keys[1], std::chrono::microseconds(0)));
+	ASSERT_TRUE(dict.generation() > generation);
+	ASSERT_EQ(dict.stats().update, 2);
+	ASSERT_EQ(audited, 2);
+	clock.time += ttl.count() - 1;
+	std::string val;
+	estuary::Estuary::RecordMeta meta;
+	ASSERT_TRUE(dict.fetch_with_meta(keys[0], val, meta));
+	ASSERT_EQ(val, "a");
+	ASSERT_EQ(meta.mtime.time_since_epoch(), std::chrono::microseconds(1000000));	//value untouched
+	clock.time += 1;
+	ASSERT_FALSE(dict.fetch(keys[0], val));
+	ASSERT_FALSE(dict.touch(keys[0], ttl));		//too late
+	clock.time += 1000000;
+	ASSERT_TRUE(dict.fetch(keys[1], val));
+	ASSERT_EQ(val, "b");
+}
+
+TEST(Estuary, Rebuild) {
+	struct FakeClock : public estuary::Clock {
+		uint64_t time = 1000000;
+		uint64_t now() override { return time; }
+		uint64_t seed() override { return 2; }
+	} clock;
+	ClockBinding binding(&clock);
+
+	const std::string filename = "rebuild.es";
+	const std::string copy = "rebuild-copy.es";
+	auto config = CONFIG;
+	config.record_stamp = true;
+	config.record_ttl = true;
+	VariedValueGenerator source(0, PIECE/2);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	source.reset();
+	for (unsigned i = 0; i < PIECE/4; i++) {
+		ASSERT_TRUE(dict.erase(source.read().key));
+	}
+	ASSERT_NE(dict.tombstone(), 0);
+	uint64_t id = PIECE;
+	const estuary::Slice key = {(const uint8_t*)&id, sizeof(uint64_t)};
+	ASSERT_TRUE(dict.update_ttl(key, {(const uint8_t*)"a", 1}, std::chrono::microseconds(10)));
+
+	clock.time += 5;
+	ASSERT_TRUE(dict.rebuild(copy));	//seed from clock is the same, but still changed
+	auto neo = estuary::Estuary::Load(copy);
+	ASSERT_FALSE(!neo);
+	ASSERT_NE(neo.hash(key), dict.hash(key));
+	ASSERT_EQ(neo.item(), dict.item());
+	ASSERT_EQ(neo.tombstone(), 0);
+
+	std::string val;
+	source.reset();
+	for (unsigned i = 0; i < PIECE/2; i++) {
+		auto rec = source.read();
+		if (i < PIECE/4) {
+			ASSERT_FALSE(neo.fetch(rec.key, val));
+			continue;
+		}
+		ASSERT_TRUE(neo.fetch(rec.key, val));
+		ASSERT_EQ(val.size(), rec.val.len);
+		ASSERT_EQ(memcmp(val.data(), rec.val.ptr, val.size()), 0);
+	}
+	estuary::Estuary::RecordMeta meta;
+	ASSERT_TRUE(neo.fetch_with_meta(key, val, meta));
+	ASSERT_EQ(val, "a");
+	ASSERT_EQ(meta.mtime.time_since_epoch(), std::chrono::microseconds(1000000));
+	clock.time += 5;
+	ASSERT_FALSE(neo.fetch(key, val));
+
+	VariedValueGenerator more(PIECE/2, PIECE/4);
+	for (unsigned i = 0; i < PIECE/4; i++) {
+		auto rec = more.read();
+		ASSERT_TRUE(neo.update(rec.key, rec.val));
+	}
+	ASSERT_TRUE(neo.self_test(PIECE*2));
+}
+
+TEST(Estuary, TTLReclaim) {
+	struct FakeClock : public estuary::Clock {
+		uint64_t time = 1000000;
+		uint64_t now() override { return time; }
+		uint64_t seed() override { return 2; }
+	} clock;
+	ClockBinding binding(&clock);
+
+	const std::string filename = "ttl-reclaim.es";
+	auto config = CONFIG;
+	config.record_ttl = true;
+	VariedValueGenerator source(0, PIECE/2);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	VariedValueGenerator temp(PIECE, PIECE/2, 0);
+	for (unsigned i = 0; i < PIECE/2; i++) {
+		auto rec = temp.read();
+		ASSERT_TRUE(dict.update_ttl(rec.key, rec.val, std::chrono::microseconds(1)));
+	}
+	clock.time++;
+	ASSERT_EQ(dict.item(), PIECE);
+
+	//relocation during allocation drops expired records instead of moving them
+	for (unsigned round = 0; round < 10 && dict.item() == PIECE; round++) {
+		VariedValueGenerator input(0, PIECE/2, round*7 + 1);
+		for (unsigned i = 0; i < PIECE/2; i++) {
+			auto rec = input.read();
+			ASSERT_TRUE(dict.update(rec.key, rec.val));
+		}
+	}
+	ASSERT_TRUE(dict.item() < PIECE);
+
+	std::string val;
+	source.reset();
+	temp.reset();
+	for (unsigned i = 0; i < PIECE/2; i++) {
+		ASSERT_TRUE(dict.fetch(source.read().key, val));
+		ASSERT_FALSE(dict.fetch(temp.read().key, val));
+	}
+}
+
+TEST(Estuary, DefaultTTL) {
+	struct FakeClock : public estuary::Clock {
+		uint64_t time = 1000000;
+		uint64_t now() override { return time; }
+		uint64_t seed() override { return 3; }
+	} clock;
+	ClockBinding binding(&clock);
+
+	const std::string filename = "default-ttl.es";
+	auto config = CONFIG;
+	config.default_ttl = std::chrono::microseconds(100);
+	VariedValueGenerator source(0, PIECE/2);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	ASSERT_EQ(dict.expire_sweep(SIZE_MAX), 0);
+
+	clock.time += 50;
+	const uint64_t id = PIECE;
+	const estuary::Slice key = {(const uint8_t*)&id, sizeof(id)};
+	ASSERT_TRUE(dict.update(key, {(const uint8_t*)"new", 3}));
+	ASSERT_TRUE(dict.update_ttl({(const uint8_t*)&id, 1}, {(const uint8_t*)"long", 4},
+								std::chrono::microseconds(1000)));
+
+	clock.time += 50;
+	std::string val;
+	source.reset();
+	ASSERT_FALSE(dict.fetch(source.read().key, val));
+	ASSERT_TRUE(dict.fetch(key, val));
+	ASSERT_EQ(dict.item(), PIECE/2 + 2);
+
+	size_t total = 0;
+	for (unsigned i = 0; i < 100; i++) {
+		auto cnt = dict.expire_sweep(64);
+		ASSERT_TRUE(cnt <= 64);
+		total += cnt;
+	}
+	ASSERT_EQ(total, PIECE/2);
+	ASSERT_EQ(dict.item(), 2);
+	ASSERT_EQ(dict.expire_sweep(SIZE_MAX), 0);
+
+	clock.time += 50;
+	ASSERT_EQ(dict.expire_sweep(SIZE_MAX), 1);
+	ASSERT_FALSE(dict.fetch(key, val));
+	ASSERT_TRUE(dict.fetch({(const uint8_t*)&id, 1}, val));
+	ASSERT_EQ(val, "long");
+
+	const uint64_t counter_id = PIECE + 1;
+	const estuary::Slice counter = {(const uint8_t*)&counter_id, sizeof(counter_id)};
+	int64_t result = 0;
+	ASSERT_TRUE(dict.add(counter, 1, result));	//created by read-modify-write helper
+	clock.time += 50;
+	ASSERT_TRUE(dict.add(counter, 1, result));	//expiry is kept
+	ASSERT_EQ(result, 2);
+	clock.time += 50;
+	ASSERT_FALSE(dict.fetch(counter, val));
+	ASSERT_TRUE(dict.add(counter, 5, result));	//expired one counts as missing
+	ASSERT_EQ(result, 5);
+	clock.time += 99;
+	ASSERT_TRUE(dict.fetch(counter, val));
+	clock.time += 1;
+	ASSERT_FALSE(dict.fetch(counter, val));
+}
+
+TEST(Estuary, Eviction) {
+	struct FakeClock : public estuary::Clock {
+		uint64_t time = 1000000;
+		uint64_t now() override { return time++; }
+		uint64_t seed() override { return 4; }
+	} clock;
+	ClockBinding binding(&clock);
+
+	const std::string filename = "eviction.es";
+	auto config = CONFIG;
+	config.record_stamp = true;
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	dict.enable_stats();
+
+	VariedValueGenerator input(PIECE, PIECE);
+	unsigned rejected = 0;
+	for (unsigned i = 0; i < PIECE/2; i++) {
+		auto rec = input.read();
+		if (!dict.update(rec.key, rec.val)) {
+			rejected++;
+		}
+	}
+	ASSERT_NE(rejected, 0);
+	ASSERT_EQ(dict.stats().evict, 0);
+	const auto full = dict.item();
+
+	dict.set_eviction(5);
+	input.reset();
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = input.read();
+		ASSERT_TRUE(dict.update(rec.key, rec.val));
+	}
+	ASSERT_TRUE(dict.item() <= full);
+	ASSERT_NE(dict.stats().evict, 0);
+
+	//the newest ones survive
+	std::string val;
+	input.reset();
+	unsigned found = 0;
+	for (unsigned i = 0; i < PIECE; i++) {
+		auto rec = input.read();
+		if (dict.fetch(rec.key, val)) {
+			found++;
+		}
+	}
+	source.reset();
+	unsigned old_found = 0;
+	for (unsigned i = 0; i < PIECE; i++) {
+		if (dict.fetch(source.read().key, val)) {
+			old_found++;
+		}
+	}
+	ASSERT_TRUE(found > old_found);
+	ASSERT_TRUE(dict.self_test(PIECE*2));
+}
+
+TEST(Estuary, Errors) {
+	using Error = estuary::Estuary::Error;
+	const std::string filename = "errors.es";
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+
+	std::string val;
+	const uint8_t buf[UINT8_MAX+1] = {};
+	ASSERT_EQ(dict.try_fetch({}, val), Error::BAD_ARGUMENT);
+	ASSERT_EQ(dict.try_fetch({buf, sizeof(uint64_t)+1}, val), Error::KEY_TOO_LONG);
+	ASSERT_EQ(dict.try_update({buf, sizeof(uint64_t)}, {buf, UINT8_MAX+1}), Error::VAL_TOO_LONG);
+	ASSERT_EQ(dict.try_update({buf, sizeof(uint64_t)}, {nullptr, 1}), Error::BAD_ARGUMENT);
+	ASSERT_EQ(dict.try_erase({buf, 0}), Error::BAD_ARGUMENT);
+
+	source.reset();
+	auto rec = source.read();
+	ASSERT_EQ(dict.try_fetch(rec.key, val), Error::OK);
+	ASSERT_EQ(dict.try_erase(rec.key), Error::OK);
+	ASSERT_EQ(dict.try_erase(rec.key), Error::NOT_FOUND);
+	ASSERT_EQ(dict.try_fetch(rec.key, val), Error::NOT_FOUND);
+	ASSERT_EQ(dict.try_update(rec.key, rec.val), Error::OK);
+
+	VariedValueGenerator input(PIECE, PIECE);
+	Error last = Error::OK;
+	for (unsigned i = 0; i < PIECE && last == Error::OK; i++) {
+		rec = input.read();
+		last = dict.try_update(rec.key, rec.val);
+	}
+	ASSERT_TRUE(last == Error::NO_SPACE || last == Error::TABLE_FULL);
+	ASSERT_EQ(std::string(estuary::Estuary::ErrorName(Error::NO_SPACE)), "no space");
+
+	dict.set_validator([](estuary::Slice, estuary::Slice)->bool { return false; });
+	ASSERT_EQ(dict.try_update(rec.key, rec.val), Error::INVALID);
+	ASSERT_TRUE(dict.freeze_writes());
+	ASSERT_EQ(dict.try_erase(rec.key), Error::FROZEN);
+}
+
+TEST(Estuary, Hooks) {
+	const std::string filename = "hooks.es";
+	VariedValueGenerator source(0, PIECE);
+	ASSERT_TRUE(estuary::Estuary::Create(filename, CONFIG, &source));
+
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	unsigned evicted = 0;
+	unsigned rejected[16] = {0};
+	estuary::Estuary::Hooks hooks;
+	hooks.on_evict = [&evicted](estuary::Slice key) {
+		ASSERT_NE(key.len, 0);
+		evicted++;
+	};
+	hooks.on_reject = [&rejected](estuary::Slice, estuary::Estuary::Error reason) {
+		rejected[(unsigned)reason]++;
+	};
+	dict.set_hooks(std::move(hooks));
+
+	VariedValueGenerator input(PIECE, PIECE);
+	for (unsigned i = 0; i < PIECE/2; i++) {
+		auto rec = input.read();
+		dict.update(rec.key, rec.val);
+	}
+	ASSERT_EQ(evicted, 0);
+	ASSERT_NE(rejected[(unsigned)estuary::Estuary::Error::NO_SPACE] + rejected[(unsigned)estuary::Estuary::Error::TABLE_FULL], 0);
+
+	dict.set_eviction(5);
+	for (unsigned i = 0; i < PIECE/2; i++) {
+		auto rec = input.read();
+		ASSERT_TRUE(dict.update(rec.key, rec.val));
+	}
+	ASSERT_NE(evicted, 0);
+
+	dict.set_validator([](estuary::Slice, estuary::Slice val)->bool {
+		return val.len != 0;
+	});
+	auto rec = input.read();
+	ASSERT_FALSE(dict.update(rec.key, {}));
+	ASSERT_EQ(rejected[(unsigned)estuary::Estuary::Error::INVALID], 1);
+
+	ASSERT_TRUE(dict.freeze_writes());
+	ASSERT_FALSE(dict.update(rec.key, rec.val));
+	ASSERT_EQ(rejected[(unsigned)estuary::Estuary::Error::FROZEN], 1);
+}
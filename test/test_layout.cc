@@ -0,0 +1,118 @@
+//==============================================================================
+// Dictionary designed for read-mostly scene.
+// Copyright (C) 2020  Ruan Kunliang
+//
+// This library is free software; you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation; either version 2.1 of the License, or (at your option)
+// any later version.
+//
+// This library is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+//==============================================================================
+
+#include <random>
+#include <vector>
+#include <gtest/gtest.h>
+#include "../src/layout.h"
+
+using namespace estuary;
+
+static bool CheckEntry(uint64_t blk, uint64_t tag, bool fit) {
+	Entry e(blk, tag);
+	e.fit = fit;
+	if (e.blk != blk || e.tag != tag || e.fit != fit) {
+		return false;
+	}
+	Entry copy = CLEAN_ENTRY;
+	copy.store_release(e);	//store through a const object, as table does
+	Entry got;
+	got.load_relaxed(copy);
+	return got.blk == blk && got.tag == tag && got.fit == fit;
+}
+
+TEST(Layout, Entry) {
+	constexpr uint64_t max_tag = (1ULL << TAG_BITWIDTH) - 1U;
+	const uint64_t blocks[] = {0, 1, DATA_BLOCK_LIMIT-1, RESERVED_ADDR-1, RESERVED_ADDR, MAX_ADDR};
+	const uint64_t tags[] = {0, 1, max_tag-1, max_tag};
+	for (auto blk : blocks) {
+		for (auto tag : tags) {
+			ASSERT_TRUE(CheckEntry(blk, tag, false));
+			ASSERT_TRUE(CheckEntry(blk, tag, true));
+		}
+	}
+	std::mt19937_64 rnd;
+	for (unsigned i = 0; i < 100000; i++) {
+		auto x = rnd();
+		ASSERT_TRUE(CheckEntry(x % (MAX_ADDR+1), x >> (64U - TAG_BITWIDTH), x & 1U));
+	}
+
+	ASSERT_FALSE(IsEmpty(Entry(0)));
+	ASSERT_FALSE(IsEmpty(Entry(DATA_BLOCK_LIMIT-1)));
+	ASSERT_TRUE(IsEmpty(DELETED_ENTRY));
+	ASSERT_FALSE(IsClean(DELETED_ENTRY));
+	ASSERT_TRUE(IsEmpty(CLEAN_ENTRY));
+	ASSERT_TRUE(IsClean(CLEAN_ENTRY));
+	ASSERT_EQ(CLEAN_ENTRY.fit, 0);
+	ASSERT_EQ(DELETED_ENTRY.fit, 0);
+}
+
+TEST(Layout, RecordMark) {
+	for (uint64_t bcnt : {0ULL, 1ULL, (1ULL<<32U), (1ULL<<56U)-1U}) {
+		auto mark = MarkForEmpty(bcnt);
+		ASSERT_EQ(mark.klen, 0);
+		ASSERT_EQ(mark.bcnt, bcnt);
+	}
+
+	std::vector<uint8_t> buf(DATA_BLOCK_SIZE*4096);
+	std::vector<uint8_t> key(UINT8_MAX);
+	std::vector<uint8_t> val(DATA_BLOCK_SIZE*4000);
+	std::mt19937_64 rnd;
+	for (auto& b : key) b = rnd();
+	for (auto& b : val) b = rnd();
+
+	auto check = [&](size_t klen, size_t vlen)->bool {
+		memset(buf.data(), 0xcc, buf.size());
+		FillRecord(buf.data(), {key.data(), klen}, {val.data(), vlen});
+		auto block = buf.data();
+		if (Rc(block).klen != klen || Rc(block).vlen != vlen
+			|| memcmp(RcKey(block), key.data(), klen) != 0
+			|| memcmp(RcVal(block), val.data(), vlen) != 0
+			|| RcExtra(block) != block + sizeof(uint32_t) + klen + vlen
+			|| !KeyMatch({key.data(), klen}, block)
+			|| !ValMatch({val.data(), vlen}, block)) {
+			return false;
+		}
+		for (size_t extra : {0UL, sizeof(uint64_t)}) {
+			auto bcnt = RecordBlocks(block, extra, DATA_BLOCK_BITS);
+			if (bcnt * DATA_BLOCK_SIZE < sizeof(uint32_t) + klen + vlen + extra
+				|| (bcnt-1) * DATA_BLOCK_SIZE >= sizeof(uint32_t) + klen + vlen + extra) {
+				return false;
+			}
+		}
+		//bytes behind record are untouched, except those in the 8-byte mark
+		return sizeof(uint32_t) + klen + vlen < sizeof(RecordMark)
+			   || buf[sizeof(uint32_t) + klen + vlen] == 0xcc;
+	};
+	for (size_t klen : {1, 2, 3, 4, 5, 8, 100, UINT8_MAX}) {
+		for (size_t vlen : {0, 1, 3, 4, 7, 8, 1000, 32000}) {
+			ASSERT_TRUE(check(klen, vlen));
+		}
+	}
+	for (unsigned i = 0; i < 1000; i++) {
+		ASSERT_TRUE(check(rnd() % UINT8_MAX + 1, rnd() % val.size()));
+	}
+
+	RecordMark mark;
+	mark.klen = UINT8_MAX;
+	mark.vlen = (1U<<24U)-1U;
+	ASSERT_EQ(mark.klen, UINT8_MAX);
+	ASSERT_EQ(mark.vlen, (1U<<24U)-1U);
+	ASSERT_EQ(RecordBlocks(UINT8_MAX, (1U<<24U)-1U, 0, DATA_BLOCK_BITS),
+			  (sizeof(uint32_t)+UINT8_MAX+(1U<<24U)-1U+DATA_BLOCK_SIZE-1)/DATA_BLOCK_SIZE);
+}
@@ -0,0 +1,273 @@
+//==============================================================================
+// Dictionary designed for read-mostly scene.
+// Copyright (C) 2020  Ruan Kunliang
+//
+// This library is free software; you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation; either version 2.1 of the License, or (at your option)
+// any later version.
+//
+// This library is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more
+// details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the This Library; if not, see <https://www.gnu.org/licenses/>.
+//==============================================================================
+
+#include <map>
+#include <atomic>
+#include <random>
+#include <string>
+#include <thread>
+#include <vector>
+#include <gtest/gtest.h>
+#include <estuary.h>
+#include "test.h"
+
+//replay random operations against a reference map, shrink to the shortest failing prefix,
+//and check concurrent readers against the window of operations each fetch overlaps
+
+namespace {
+
+struct Operation {
+	enum Kind {UPDATE, ERASE, FETCH} kind;
+	uint64_t key;
+	std::string val;
+};
+
+//fixed time and seed make failures reproducible
+struct FixedClock : public estuary::Clock {
+	uint64_t now() override { return 1600000000000000ULL; }
+	uint64_t seed() override { return 1596176575357415943ULL; }
+};
+
+constexpr unsigned KEY_SPACE = 600;
+constexpr unsigned ITEM_LIMIT = 1000;
+
+std::vector<Operation> Generate(uint64_t seed, unsigned n) {
+	std::mt19937_64 rnd(seed);
+	std::vector<Operation> ops(n);
+	for (auto& op : ops) {
+		auto x = rnd() % 10;
+		op.kind = x < 4? Operation::UPDATE : (x < 6? Operation::ERASE : Operation::FETCH);
+		op.key = rnd() % KEY_SPACE;
+		if (op.kind == Operation::UPDATE) {
+			op.val.resize(rnd() % UINT8_MAX);
+			for (auto& ch : op.val) {
+				ch = rnd();
+			}
+		}
+	}
+	return ops;
+}
+
+//return index of first mismatched operation, or ops.size() if all pass
+size_t Replay(const std::vector<Operation>& ops, size_t n) {
+	const std::string filename = "simulation.es";
+	estuary::Estuary::Config config;
+	config.item_limit = ITEM_LIMIT;
+	config.max_key_len = sizeof(uint64_t);
+	config.max_val_len = UINT8_MAX;
+	config.avg_size_per_item = UINT8_MAX/2 + 1 + sizeof(uint64_t);
+	config.concurrency = 1;
+	if (!estuary::Estuary::Create(filename, config)) {
+		return 0;
+	}
+	auto dict = estuary::Estuary::Load(filename);
+	if (!dict) {
+		return 0;
+	}
+
+	std::map<uint64_t, std::string> model;
+	std::string out;
+	for (size_t i = 0; i < n; i++) {
+		auto& op = ops[i];
+		estuary::Slice key = {(const uint8_t*)&op.key, sizeof(op.key)};
+		switch (op.kind) {
+			case Operation::UPDATE:
+				if (!dict.update(key, {(const uint8_t*)op.val.data(), op.val.size()})) {
+					return i;
+				}
+				model[op.key] = op.val;
+				break;
+			case Operation::ERASE:
+				if (dict.erase(key) != (model.erase(op.key) != 0)) {
+					return i;
+				}
+				break;
+			case Operation::FETCH: {
+				auto it = model.find(op.key);
+				if (dict.fetch(key, out) != (it != model.end())
+					|| (it != model.end() && out != it->second)) {
+					return i;
+				}
+			}
+				break;
+		}
+		if (dict.item() != model.size()) {
+			return i;
+		}
+	}
+	for (auto& [k, v] : model) {
+		if (!dict.fetch({(const uint8_t*)&k, sizeof(k)}, out) || out != v) {
+			return n;
+		}
+	}
+	return n + 1;
+}
+
+//value carries its key and operation sequence, so readers can tell where it comes from
+std::string MakeValue(uint64_t key, uint32_t seq, unsigned len) {
+	std::string val(sizeof(key) + sizeof(seq) + len, (char)(seq * 31U + key));
+	memcpy(val.data(), &key, sizeof(key));
+	memcpy(val.data()+sizeof(key), &seq, sizeof(seq));
+	return val;
+}
+
+bool ParseValue(const std::string& val, uint64_t key, uint32_t& seq) {
+	uint64_t k = 0;
+	if (val.size() < sizeof(k) + sizeof(seq)) {
+		return false;
+	}
+	memcpy(&k, val.data(), sizeof(k));
+	memcpy(&seq, val.data()+sizeof(k), sizeof(seq));
+	if (k != key) {
+		return false;
+	}
+	for (size_t i = sizeof(k) + sizeof(seq); i < val.size(); i++) {
+		if (val[i] != (char)(seq * 31U + key)) {
+			return false;
+		}
+	}
+	return true;
+}
+
+} //namespace
+
+TEST(Simulation, RandomOperations) {
+	estuary::Logger::Bind(nullptr);
+	FixedClock clock;
+	ClockBinding binding(&clock);
+	constexpr unsigned ROUND = 8;
+	constexpr unsigned LENGTH = 20000;
+	for (uint64_t seed = 1; seed <= ROUND; seed++) {
+		auto ops = Generate(seed, LENGTH);
+		auto bad = Replay(ops, ops.size());
+		if (bad <= ops.size()) {
+			size_t lo = 0, hi = ops.size();
+			while (lo < hi) {	//shrink
+				auto mid = (lo + hi) / 2;
+				if (Replay(ops, mid) <= mid) {
+					hi = mid;
+				} else {
+					lo = mid + 1;
+				}
+			}
+			fprintf(stderr, "seed %lu fails with %lu operations\n", seed, lo);
+		}
+		ASSERT_EQ(bad, ops.size()+1);
+	}
+}
+
+TEST(Simulation, ConcurrentReaders) {
+	const std::string filename = "simulation-mt.es";
+	estuary::Estuary::Config config;
+	config.item_limit = ITEM_LIMIT;
+	config.max_key_len = sizeof(uint64_t);
+	config.max_val_len = UINT8_MAX;
+	config.avg_size_per_item = UINT8_MAX/2 + 1 + sizeof(uint64_t);
+	config.concurrency = 4;
+	ASSERT_TRUE(estuary::Estuary::Create(filename, config));
+	auto dict = estuary::Estuary::Load(filename);
+	ASSERT_FALSE(!dict);
+	std::atomic<unsigned> sweep(0);
+	estuary::Estuary::Hooks hooks;
+	hooks.on_sweep = [&sweep](size_t) { sweep++; };
+	dict.set_hooks(std::move(hooks));
+	dict.set_tombstone_limit(0.02);	//sweep often
+
+	//per key: sequence of the last started operation, of the last started erase,
+	//and of the last finished operation (shifted, with lowest bit for presence)
+	struct State {
+		std::atomic<uint32_t> begun{0};
+		std::atomic<uint32_t> erasing{0};
+		std::atomic<uint64_t> done{0};
+	};
+	std::vector<State> states(KEY_SPACE);
+	std::atomic<bool> quit(false);
+	std::atomic<uint64_t> checked(0);
+	std::atomic<uint64_t> broken(0);
+
+	auto reader = [&](uint64_t seed) {
+		std::mt19937_64 rnd(seed);
+		std::string out;
+		uint64_t cnt = 0;
+		while (!quit) {
+			const uint64_t key = rnd() % KEY_SPACE;
+			auto& state = states[key];
+			const auto before = state.done.load();
+			const bool found = dict.fetch({(const uint8_t*)&key, sizeof(key)}, out);
+			const auto erasing = state.erasing.load();
+			const auto after = state.begun.load();
+			uint32_t seq = 0;
+			if (found) {
+				//written by the last finished update or one started during the fetch
+				if (!ParseValue(out, key, seq) || seq < (before >> 1U) || seq > after) {
+					broken++;
+				}
+			} else if ((before & 1U) != 0 && erasing <= (before >> 1U)) {
+				broken++;	//present all the time but missed
+			}
+			cnt++;
+		}
+		checked += cnt;
+	};
+	std::vector<std::thread> readers;
+	for (unsigned i = 0; i < 3; i++) {
+		readers.emplace_back(reader, i+1);
+	}
+
+	std::mt19937_64 rnd(99);
+	std::map<uint64_t, std::string> model;
+	constexpr unsigned LENGTH = 200000;
+	uint32_t fail = 0;
+	for (uint32_t seq = 1; seq <= LENGTH && fail == 0; seq++) {
+		const uint64_t key = rnd() % KEY_SPACE;
+		auto& state = states[key];
+		const estuary::Slice k = {(const uint8_t*)&key, sizeof(key)};
+		if (rnd() % 10 < 6) {
+			auto val = MakeValue(key, seq, rnd() % (UINT8_MAX - sizeof(uint64_t) - sizeof(uint32_t)));
+			state.begun = seq;
+			if (!dict.update(k, {(const uint8_t*)val.data(), val.size()})) {
+				fail = seq;
+			}
+			state.done = ((uint64_t)seq << 1U) | 1U;
+			model[key] = std::move(val);
+		} else {
+			state.erasing = seq;
+			state.begun = seq;
+			if (dict.erase(k) != (model.erase(key) != 0)) {
+				fail = seq;
+			}
+			state.done = (uint64_t)seq << 1U;
+		}
+	}
+	quit = true;
+	for (auto& t : readers) {
+		t.join();
+	}
+	ASSERT_EQ(fail, 0U);
+	ASSERT_EQ(broken, 0U);
+	ASSERT_NE(checked, 0U);
+	ASSERT_NE(sweep, 0U);
+
+	ASSERT_EQ(dict.item(), model.size());
+	std::string out;
+	for (auto& [k, v] : model) {
+		ASSERT_TRUE(dict.fetch({(const uint8_t*)&k, sizeof(k)}, out));
+		ASSERT_EQ(out, v);
+	}
+	ASSERT_TRUE(dict.self_test(ITEM_LIMIT*2));
+}
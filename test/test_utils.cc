@@ -16,6 +16,7 @@
 // along with the This Library; if not, see <https://www.gnu.org/licenses/>.
 //==============================================================================
 
+#include <cstring>
 #include <limits>
 #include <random>
 #include <gtest/gtest.h>
@@ -75,3 +76,30 @@ TEST(Divisor, Uint8) {
 }
 
 
+static bool Match(const char* pattern, const char* text) {
+	return estuary::GlobMatch({(const uint8_t*)pattern, strlen(pattern)}, {(const uint8_t*)text, strlen(text)});
+}
+
+TEST(Glob, Match) {
+	ASSERT_TRUE(Match("", ""));
+	ASSERT_TRUE(Match("*", ""));
+	ASSERT_TRUE(Match("*", "abc"));
+	ASSERT_TRUE(Match("a*", "abc"));
+	ASSERT_TRUE(Match("*c", "abc"));
+	ASSERT_TRUE(Match("a*c", "abbbc"));
+	ASSERT_TRUE(Match("a?c", "abc"));
+	ASSERT_TRUE(Match("user:*:name", "user:42:name"));
+	ASSERT_TRUE(Match("[a-c]x", "bx"));
+	ASSERT_TRUE(Match("[!a-c]x", "dx"));
+	ASSERT_TRUE(Match("a\\*", "a*"));
+	ASSERT_TRUE(Match("[]]", "]"));
+	ASSERT_TRUE(Match("[", "["));
+
+	ASSERT_FALSE(Match("", "a"));
+	ASSERT_FALSE(Match("a*", "bac"));
+	ASSERT_FALSE(Match("a?c", "ac"));
+	ASSERT_FALSE(Match("[a-c]x", "dx"));
+	ASSERT_FALSE(Match("[!a-c]x", "ax"));
+	ASSERT_FALSE(Match("a\\*", "ab"));
+	ASSERT_FALSE(Match("user:*:name", "user:42:mail"));
+}